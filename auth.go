@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Credential is a token or password accepted by a hook. The value can be
+// given directly, read from a file, or read from an environment variable.
+type Credential struct {
+	// User name, for HTTP Basic authentication. Ignored for tokens.
+	User string
+
+	// Exactly one of these should be given.
+	Value string
+	File  string
+	Env   string
+
+	value string
+}
+
+// resolve returns the credential's value, reading it from its file or
+// environment variable if necessary.
+func (c *Credential) resolve() (string, error) {
+	sources := 0
+	for _, s := range []string{c.Value, c.File, c.Env} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return "", errors.New("credential must have exactly one of Value, File, or Env")
+	}
+
+	value := c.Value
+	if c.File != "" {
+		data, err := ioutil.ReadFile(c.File)
+		if err != nil {
+			return "", err
+		}
+		value = strings.TrimSpace(string(data))
+	} else if c.Env != "" {
+		registerSecretEnv(c.Env)
+		value = os.Getenv(c.Env)
+	}
+
+	if value == "" {
+		return "", fmt.Errorf("credential for user %q is empty", c.User)
+	}
+
+	registerSecret(value)
+	return value, nil
+}
+
+// HasCredentials returns true if the hook requires an Authorization header.
+func (hook *Hook) HasCredentials() bool {
+	return len(hook.AuthTokens) != 0 || len(hook.BasicAuth) != 0
+}
+
+// LoadCredentials loads the values of all the hook's credentials. If any
+// of them fail to load, the existing values are left in place.
+func (hook *Hook) LoadCredentials() error {
+	tokens := make([]string, len(hook.AuthTokens))
+	for i := range hook.AuthTokens {
+		var err error
+		tokens[i], err = hook.AuthTokens[i].resolve()
+		if err != nil {
+			return fmt.Errorf("AuthTokens[%d]: %s", i, err)
+		}
+	}
+
+	passwords := make([]string, len(hook.BasicAuth))
+	for i := range hook.BasicAuth {
+		if hook.BasicAuth[i].User == "" {
+			return fmt.Errorf("BasicAuth[%d]: no User given", i)
+		}
+
+		var err error
+		passwords[i], err = hook.BasicAuth[i].resolve()
+		if err != nil {
+			return fmt.Errorf("BasicAuth[%d]: %s", i, err)
+		}
+	}
+
+	hook.secretLock.Lock()
+	defer hook.secretLock.Unlock()
+	for i := range tokens {
+		hook.AuthTokens[i].value = tokens[i]
+	}
+	for i := range passwords {
+		hook.BasicAuth[i].value = passwords[i]
+	}
+
+	return nil
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// CheckAuthorization verifies the request's Authorization header against the
+// hook's credentials. Every credential is compared so that the time taken
+// doesn't reveal which one, if any, came close to matching.
+func (hook *Hook) CheckAuthorization(r *http.Request) bool {
+	if !hook.HasCredentials() {
+		return true
+	}
+
+	hook.secretLock.RLock()
+	defer hook.secretLock.RUnlock()
+
+	matched := false
+
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token := strings.TrimSpace(header[len("Bearer "):])
+		for _, c := range hook.AuthTokens {
+			if constantTimeEqual(c.value, token) {
+				matched = true
+			}
+		}
+	} else if user, password, ok := r.BasicAuth(); ok {
+		for _, c := range hook.BasicAuth {
+			userOk := constantTimeEqual(c.User, user)
+			passwordOk := constantTimeEqual(c.value, password)
+			if userOk && passwordOk {
+				matched = true
+			}
+		}
+	}
+
+	return matched
+}
+
+// authChallenge returns the WWW-Authenticate header to send when
+// authorization fails.
+func (hook *Hook) authChallenge() string {
+	if len(hook.BasicAuth) != 0 {
+		return `Basic realm="unwebhook"`
+	}
+	return "Bearer"
+}
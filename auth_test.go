@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestCheckAuthorization(t *testing.T) {
+	os.Setenv("UNWEBHOOK_TEST_TOKEN", "envtoken")
+
+	hook := &Hook{
+		AuthTokens: []Credential{
+			Credential{Value: "abcd"},
+			Credential{Env: "UNWEBHOOK_TEST_TOKEN"},
+		},
+		BasicAuth: []Credential{
+			Credential{User: "monitor", Value: "hunter2"},
+		},
+	}
+
+	err := hook.LoadCredentials()
+	if err != nil {
+		t.Fatal("Failed loading credentials:", err)
+	}
+
+	type authTest struct {
+		Header  string
+		Allowed bool
+	}
+
+	tests := []authTest{
+		authTest{"", false},
+		authTest{"Bearer abcd", true},
+		authTest{"Bearer envtoken", true},
+		authTest{"Bearer abc", false},
+		authTest{"Bearer ", false},
+		// monitor:hunter2
+		authTest{"Basic bW9uaXRvcjpodW50ZXIy", true},
+		// monitor:hunter3
+		authTest{"Basic bW9uaXRvcjpodW50ZXIz", false},
+		// other:hunter2
+		authTest{"Basic b3RoZXI6aHVudGVyMg==", false},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest("POST", "/hook", nil)
+		if test.Header != "" {
+			r.Header.Set("Authorization", test.Header)
+		}
+
+		if hook.CheckAuthorization(r) != test.Allowed {
+			t.Errorf("Authorization %q: expected allowed=%v", test.Header, test.Allowed)
+		}
+	}
+}
+
+func TestCredentialLoadError(t *testing.T) {
+	bad := []Credential{
+		Credential{},
+		Credential{Value: "a", Env: "B"},
+		Credential{File: "/nonexistent/unwebhook/secret"},
+	}
+
+	for _, c := range bad {
+		if _, err := c.resolve(); err == nil {
+			t.Errorf("Expected error loading %+v", c)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// LoadTLSConfig creates the TLS configuration for the server. When a client
+// CA file is given, client certificates signed by that CA are verified if
+// the client presents one. Requiring a certificate is left to the individual
+// hooks, since forges like GitHub can't present one.
+func LoadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", clientCAFile)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// verifiedClientCert returns the verified client certificate for the request,
+// or nil if the client did not present one.
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 ||
+		len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certSANs returns all the subject alternative names in the certificate,
+// as strings.
+func certSANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+
+		len(cert.IPAddresses)+len(cert.URIs))
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// clientCertInfo converts the certificate into the form exposed to templates
+// as .unwebhook.client_cert.
+func clientCertInfo(cert *x509.Certificate) map[string]interface{} {
+	sans := make([]interface{}, 0)
+	for _, san := range certSANs(cert) {
+		sans = append(sans, san)
+	}
+
+	return map[string]interface{}{
+		"subject":     cert.Subject.String(),
+		"common_name": cert.Subject.CommonName,
+		"issuer":      cert.Issuer.String(),
+		"serial":      cert.SerialNumber.String(),
+		"sans":        sans,
+	}
+}
+
+// CheckClientCert verifies that the client certificate is allowed to call
+// the hook. If the hook has no client certificate restrictions, any request
+// is allowed.
+func (hook *Hook) CheckClientCert(cert *x509.Certificate) error {
+	if len(hook.AllowClientCN) == 0 && len(hook.AllowClientSAN) == 0 {
+		return nil
+	}
+
+	if cert == nil {
+		return errors.New("no verified client certificate")
+	}
+
+	if hook.allowClientCN.MatchAny(cert.Subject.CommonName) {
+		return nil
+	}
+
+	for _, san := range certSANs(cert) {
+		if hook.allowClientSAN.MatchAny(san) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("client certificate %q not allowed", cert.Subject.CommonName)
+}
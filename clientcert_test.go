@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestCheckClientCert(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "builder-01.build.example.com"},
+		DNSNames: []string{"builder-01.internal"},
+	}
+
+	type certTest struct {
+		CN      []string
+		SAN     []string
+		Cert    *x509.Certificate
+		Allowed bool
+	}
+
+	tests := []certTest{
+		certTest{nil, nil, nil, true},
+		certTest{nil, nil, cert, true},
+		certTest{[]string{"*.build.example.com"}, nil, nil, false},
+		certTest{[]string{"*.build.example.com"}, nil, cert, true},
+		certTest{[]string{"deploy.example.com"}, nil, cert, false},
+		certTest{nil, []string{"builder-*.internal"}, cert, true},
+		certTest{nil, []string{"*.example.com"}, cert, false},
+		certTest{[]string{"deploy.example.com"}, []string{"builder-01.internal"}, cert, true},
+		certTest{[]string{`re:^builder-\d+\.build\.example\.com$`}, nil, cert, true},
+	}
+
+	for _, test := range tests {
+		hook := &Hook{AllowClientCN: test.CN, AllowClientSAN: test.SAN}
+		if err := hook.CompileFilters(); err != nil {
+			t.Fatal(err)
+		}
+		err := hook.CheckClientCert(test.Cert)
+		if test.Allowed && err != nil {
+			t.Errorf("CN %v, SAN %v: expected allowed, got %s", test.CN, test.SAN, err)
+		} else if !test.Allowed && err == nil {
+			t.Errorf("CN %v, SAN %v: expected rejection", test.CN, test.SAN)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// newRunID returns a random ID for a single run of a hook.
+func newRunID() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return fmt.Sprintf("%x", os.Getpid())
+	}
+	return hex.EncodeToString(id)
+}
+
+// splitEnv splits a "name=value" environment entry.
+func splitEnv(entry string) (string, string) {
+	eq := strings.IndexByte(entry, '=')
+	if eq == -1 {
+		return entry, ""
+	}
+	return entry[:eq], entry[eq+1:]
+}
+
+// eventSHA returns the commit that the event is about. In PerCommit mode
+// this is the current commit.
+func eventSHA(e Event) string {
+	if c, ok := e["commit"].(map[string]interface{}); ok {
+		if id := stringField(c, "id"); id != "" {
+			return id
+		}
+	}
+
+	for _, key := range []string{"after", "checkout_sha"} {
+		if sha, ok := e[key].(string); ok && sha != "" {
+			return sha
+		}
+	}
+
+	if head, ok := e["head_commit"].(map[string]interface{}); ok {
+		return stringField(head, "id")
+	}
+
+	return ""
+}
+
+// standardEnv returns the UNWEBHOOK_* variables added to every command's
+// environment.
+func (hook *Hook) standardEnv(e Event, runID string) []string {
+	data := unwebhookData(e)
+	delivery, _ := data["delivery"].(string)
+	eventType, _ := e["type"].(string)
+	ref, _ := e["ref"].(string)
+
+	return []string{
+		"UNWEBHOOK_HOOK_URL=" + hook.Url,
+		"UNWEBHOOK_EVENT=" + eventType,
+		"UNWEBHOOK_DELIVERY=" + delivery,
+		"UNWEBHOOK_REF=" + ref,
+		"UNWEBHOOK_SHA=" + eventSHA(e),
+		"UNWEBHOOK_REPO=" + e.RepoName(),
+		"UNWEBHOOK_RUN_ID=" + runID,
+	}
+}
+
+// mergeEnv returns base with each of the overrides added, replacing any
+// existing entries with the same name.
+func mergeEnv(base []string, overrides ...string) []string {
+	result := make([]string, 0, len(base)+len(overrides))
+	index := make(map[string]int, len(base)+len(overrides))
+
+	for _, list := range [][]string{base, overrides} {
+		for _, entry := range list {
+			name, _ := splitEnv(entry)
+			if i, ok := index[name]; ok {
+				result[i] = entry
+			} else {
+				index[name] = len(result)
+				result = append(result, entry)
+			}
+		}
+	}
+
+	return result
+}
+
+// inheritedEnv returns the entries from the server's environment named in
+// InheritEnv.
+func (hook *Hook) inheritedEnv() []string {
+	env := make([]string, 0, len(hook.InheritEnv))
+	for _, name := range hook.InheritEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// buildEnv creates the environment for the hook's commands from the
+// rendered Env entries, according to EnvMode. Variables that secrets or
+// credentials were read from are never inherited. When the hook has a User,
+// HOME, USER and LOGNAME describe that user unless Env sets them. The extra
+// variables are always added.
+func (hook *Hook) buildEnv(custom []string, extra []string) []string {
+	var base []string
+	switch hook.EnvMode {
+	case "replace":
+		// For compatibility, a hook with no Env inherits everything.
+		if len(custom) == 0 {
+			base = os.Environ()
+		} else {
+			base = hook.inheritedEnv()
+		}
+
+	case "allowlist":
+		base = hook.inheritedEnv()
+
+	default:
+		base = os.Environ()
+	}
+
+	base = mergeEnv(withoutSecretEnv(base), hook.runAsEnv()...)
+	env := mergeEnv(base, custom...)
+	return mergeEnv(env, extra...)
+}
+
+func validEnvMode(mode string) bool {
+	switch mode {
+	case "", "merge", "replace", "allowlist":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestStandardEnv(t *testing.T) {
+	e, err := NewEvent([]byte(githubPush), "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwebhookData(e)["delivery"] = "72d3162e"
+
+	hook := &Hook{Url: "/deploy"}
+	env := map[string]string{}
+	for _, v := range hook.standardEnv(e, "abcd") {
+		name, value := splitEnv(v)
+		env[name] = value
+	}
+
+	expected := map[string]string{
+		"UNWEBHOOK_HOOK_URL": "/deploy",
+		"UNWEBHOOK_EVENT":    "push",
+		"UNWEBHOOK_DELIVERY": "72d3162e",
+		"UNWEBHOOK_REF":      "refs/heads/master",
+		"UNWEBHOOK_SHA":      "56d108b544ffb290e2d9088bf45ff6951d4e80df",
+		"UNWEBHOOK_REPO":     "dimfeld/unwebhook",
+		"UNWEBHOOK_RUN_ID":   "abcd",
+	}
+
+	for name, value := range expected {
+		if env[name] != value {
+			t.Errorf("Expected %s=%s, got %s", name, value, env[name])
+		}
+	}
+
+	// In PerCommit mode, the SHA is the current commit's.
+	e["commit"] = map[string]interface{}{"id": "b6568db1"}
+	if sha := eventSHA(e); sha != "b6568db1" {
+		t.Errorf("Expected current commit SHA, got %s", sha)
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	os.Setenv("UNWEBHOOK_TEST_INHERIT", "inherited")
+	os.Setenv("UNWEBHOOK_TEST_OTHER", "other")
+
+	type envTest struct {
+		Mode     string
+		Custom   []string
+		Expected map[string]string
+	}
+
+	tests := []envTest{
+		envTest{"", []string{"UNWEBHOOK_TEST_OTHER=override"}, map[string]string{
+			"UNWEBHOOK_TEST_INHERIT": "inherited",
+			"UNWEBHOOK_TEST_OTHER":   "override",
+			"UNWEBHOOK_EXTRA":        "extra",
+		}},
+		envTest{"replace", []string{"A=1"}, map[string]string{
+			"UNWEBHOOK_TEST_INHERIT": "inherited",
+			"UNWEBHOOK_TEST_OTHER":   "",
+			"A":                      "1",
+			"UNWEBHOOK_EXTRA":        "extra",
+		}},
+		envTest{"replace", nil, map[string]string{
+			"UNWEBHOOK_TEST_OTHER": "other",
+		}},
+		envTest{"allowlist", nil, map[string]string{
+			"UNWEBHOOK_TEST_INHERIT": "inherited",
+			"UNWEBHOOK_TEST_OTHER":   "",
+		}},
+	}
+
+	for _, test := range tests {
+		hook := &Hook{EnvMode: test.Mode, InheritEnv: []string{"UNWEBHOOK_TEST_INHERIT"}}
+		env := map[string]string{}
+		for _, entry := range hook.buildEnv(test.Custom, []string{"UNWEBHOOK_EXTRA=extra"}) {
+			name, value := splitEnv(entry)
+			env[name] = value
+		}
+
+		for name, value := range test.Expected {
+			if env[name] != value {
+				t.Errorf("Mode %q: expected %s=%q, got %q", test.Mode, name, value, env[name])
+			}
+		}
+	}
+}
+
+func TestSecretEnvNotInherited(t *testing.T) {
+	os.Setenv("UNWEBHOOK_TEST_SECRET", "hooksecret")
+	os.Setenv("UNWEBHOOK_TEST_TOKEN", "hooktoken")
+
+	hook := &Hook{
+		Url:        "/test",
+		SecretEnv:  "UNWEBHOOK_TEST_SECRET",
+		AuthTokens: []Credential{Credential{Env: "UNWEBHOOK_TEST_TOKEN"}},
+	}
+	if err := hook.LoadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.LoadCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other hooks mustn't see them either.
+	other := &Hook{Url: "/other", EnvMode: "replace", InheritEnv: []string{"UNWEBHOOK_TEST_SECRET"}}
+	for _, h := range []*Hook{hook, other} {
+		for _, entry := range h.buildEnv(nil, nil) {
+			name, _ := splitEnv(entry)
+			if name == "UNWEBHOOK_TEST_SECRET" || name == "UNWEBHOOK_TEST_TOKEN" {
+				t.Errorf("Hook %s: %s was passed to commands", h.Url, name)
+			}
+		}
+	}
+}
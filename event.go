@@ -2,7 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/dimfeld/glog"
+	"net/url"
+	"strings"
 )
 
 type Event map[string]interface{}
@@ -25,6 +29,113 @@ func (e Event) Commits() []interface{} {
 	return interfaceList
 }
 
+// CommitFiles returns the paths added, modified, or removed by a commit.
+// The second return value is false if the commit has no file lists. GitHub
+// and GitLab push commits both have them.
+func CommitFiles(c map[string]interface{}) ([]string, bool) {
+	files := make([]string, 0)
+	found := false
+	for _, key := range []string{"added", "modified", "removed"} {
+		list, ok := c[key].([]interface{})
+		if !ok {
+			continue
+		}
+		found = true
+
+		for _, generic := range list {
+			if file, ok := generic.(string); ok {
+				files = append(files, file)
+			}
+		}
+	}
+	return files, found
+}
+
+// ChangedFiles returns the union of the paths changed by all the commits
+// in the event. The second return value is false if the event has no
+// information about changed files.
+func (e Event) ChangedFiles() ([]string, bool) {
+	commits := e.Commits()
+	if commits == nil {
+		return nil, false
+	}
+
+	seen := map[string]bool{}
+	files := make([]string, 0)
+	found := false
+	for _, generic := range commits {
+		c, ok := generic.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		commitFiles, ok := CommitFiles(c)
+		if !ok {
+			continue
+		}
+		found = true
+
+		for _, file := range commitFiles {
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	return files, found
+}
+
+// RepoName returns the repository's name in the form "owner/name", or an
+// empty string if it can't be determined. GitLab repositories in subgroups
+// include every level of the namespace.
+func (e Event) RepoName() string {
+	if repo, ok := e["repository"].(map[string]interface{}); ok {
+		// GitHub
+		if fullName, ok := repo["full_name"].(string); ok && fullName != "" {
+			return fullName
+		}
+	}
+
+	if project, ok := e["project"].(map[string]interface{}); ok {
+		// Newer GitLab events
+		if path, ok := project["path_with_namespace"].(string); ok && path != "" {
+			return path
+		}
+	}
+
+	repo, ok := e["repository"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	// Older GitLab events only have URLs.
+	if homepage, ok := repo["homepage"].(string); ok && homepage != "" {
+		if u, err := url.Parse(homepage); err == nil && u.Path != "" {
+			return strings.Trim(u.Path, "/")
+		}
+	}
+
+	// Older GitHub events have the owner's name but no full name.
+	name, _ := repo["name"].(string)
+	if owner, ok := repo["owner"].(map[string]interface{}); ok && name != "" {
+		for _, key := range []string{"login", "name"} {
+			if ownerName, ok := owner[key].(string); ok && ownerName != "" {
+				return ownerName + "/" + name
+			}
+		}
+	}
+
+	if repoUrl, ok := repo["url"].(string); ok {
+		// Handle SSH URLs like git@example.com:owner/name.git
+		if colon := strings.LastIndex(repoUrl, ":"); colon != -1 &&
+			!strings.Contains(repoUrl, "://") {
+			return strings.TrimSuffix(strings.Trim(repoUrl[colon+1:], "/"), ".git")
+		}
+	}
+
+	return ""
+}
+
 // The docs I saw were outdated. There's no need for this since the formats are actually
 // the same.
 /*
@@ -68,6 +179,11 @@ func NewEvent(jsonData []byte, eventName string) (Event, error) {
 		return nil, err
 	}
 
+	// A JSON null unmarshals without error, but leaves no map.
+	if e == nil {
+		return nil, errors.New("JSON body is null")
+	}
+
 	if payload, ok := e["object_attributes"].(map[string]interface{}); ok {
 		// For GitLab events, export all object_attributes fields into the event scope.
 		for key, value := range payload {
@@ -76,7 +192,7 @@ func NewEvent(jsonData []byte, eventName string) (Event, error) {
 	}
 
 	if glog.V(3) {
-		glog.Infof("Event: %v", e)
+		glog.Infof("Event: %s", redact(fmt.Sprint(e)))
 	}
 
 	if eventName == "" {
@@ -93,3 +209,12 @@ func NewEvent(jsonData []byte, eventName string) (Event, error) {
 	}
 	return e, nil
 }
+
+// Create an event for a request whose body isn't a JSON object, such as a
+// plain text body or an empty GET request. The body is available as "body".
+func NewRawEvent(body []byte, eventName string) Event {
+	return Event{
+		"type": eventName,
+		"body": string(body),
+	}
+}
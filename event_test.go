@@ -20,6 +20,52 @@ func TestGitlabEvent(t *testing.T) {
 
 }
 
+func TestRepoName(t *testing.T) {
+	type repoTest struct {
+		Json string
+		Name string
+	}
+
+	tests := []repoTest{
+		repoTest{`{"repository": {"full_name": "dimfeld/unwebhook", "name": "unwebhook"}}`, "dimfeld/unwebhook"},
+		repoTest{githubPush, "dimfeld/unwebhook"},
+		repoTest{gitlabPush, "diaspora"},
+		repoTest{`{"project": {"path_with_namespace": "group/sub/project"}}`, "group/sub/project"},
+		repoTest{`{"repository": {"url": "git@example.com:team/app.git"}}`, "team/app"},
+		repoTest{gitlabIssue, ""},
+	}
+
+	for _, test := range tests {
+		e, err := NewEvent([]byte(test.Json), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if name := e.RepoName(); name != test.Name {
+			t.Errorf("Expected repository %q, got %q", test.Name, name)
+		}
+	}
+}
+
+func TestRawEvent(t *testing.T) {
+	e := NewRawEvent([]byte("deploy now"), "")
+	if e["body"] != "deploy now" {
+		t.Errorf("Unexpected body %v", e["body"])
+	}
+
+	if eventType, ok := e["type"].(string); !ok || eventType != "" {
+		t.Errorf("Unexpected type %v", e["type"])
+	}
+}
+
+func TestNonObjectJSON(t *testing.T) {
+	for _, body := range []string{"null", "[1, 2]", "42", `"deploy"`, "true"} {
+		if _, err := NewEvent([]byte(body), ""); err == nil {
+			t.Errorf("Body %s: expected an error", body)
+		}
+	}
+}
+
 const githubPush string = `{
   "ref": "refs/heads/master",
   "after": "56d108b544ffb290e2d9088bf45ff6951d4e80df",
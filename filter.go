@@ -0,0 +1,453 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dimfeld/glog"
+	"regexp"
+	"strings"
+)
+
+// CompileFilters parses the patterns used to filter events.
+func (hook *Hook) CompileFilters() error {
+	var err error
+
+	hook.allowBranches, err = CompilePatterns(hook.AllowBranches)
+	if err != nil {
+		return err
+	}
+
+	hook.allowTags, err = CompilePatterns(hook.AllowTags)
+	if err != nil {
+		return err
+	}
+
+	hook.denyBranches, err = CompilePatterns(hook.DenyBranches)
+	if err != nil {
+		return err
+	}
+
+	hook.allowRepos, err = CompilePatterns(hook.AllowRepos)
+	if err != nil {
+		return err
+	}
+
+	hook.allowPaths, err = CompilePatterns(hook.AllowPaths)
+	if err != nil {
+		return err
+	}
+
+	hook.ignorePaths, err = CompilePatterns(hook.IgnorePaths)
+	if err != nil {
+		return err
+	}
+
+	hook.allowClientCN, err = CompilePatterns(hook.AllowClientCN)
+	if err != nil {
+		return err
+	}
+
+	hook.allowClientSAN, err = CompilePatterns(hook.AllowClientSAN)
+	if err != nil {
+		return err
+	}
+
+	hook.skipMessages = make([]*regexp.Regexp, len(hook.SkipIfMessageMatches))
+	for i, expr := range hook.SkipIfMessageMatches {
+		hook.skipMessages[i], err = regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("Bad SkipIfMessageMatches %q: %s", expr, err)
+		}
+	}
+
+	for name, value := range map[string]string{
+		"OnCreated": hook.OnCreated,
+		"OnDeleted": hook.OnDeleted,
+		"OnForced":  hook.OnForced,
+	} {
+		switch value {
+		case "", "allow", "deny", "only":
+		default:
+			return fmt.Errorf("%s must be \"allow\", \"deny\", or \"only\", not %q", name, value)
+		}
+	}
+
+	switch hook.SkipCommits {
+	case "", "head", "all":
+	default:
+		return fmt.Errorf("SkipCommits must be \"head\" or \"all\", not %q", hook.SkipCommits)
+	}
+
+	return nil
+}
+
+// eventAction returns the action of the event, such as "opened" for a
+// pull request. GitHub puts this at the top level, and GitLab puts it in
+// object_attributes.
+func eventAction(e Event) (string, bool) {
+	if action, ok := e["action"].(string); ok {
+		return action, true
+	}
+
+	if attrs, ok := e["object_attributes"].(map[string]interface{}); ok {
+		if action, ok := attrs["action"].(string); ok {
+			return action, true
+		}
+	}
+
+	return "", false
+}
+
+// allowEvent checks the event's type and action against AllowEvent and
+// AllowAction. AllowEvent entries can include an action, as in
+// "pull_request.closed".
+func (hook *Hook) allowEvent(e Event) bool {
+	if len(hook.AllowEvent) == 0 && len(hook.AllowAction) == 0 {
+		return true
+	}
+
+	eventType, ok := e["type"].(string)
+	if !ok {
+		glog.Warningf("Received non-string event type %T: %v", e["type"], e["type"])
+		return false
+	}
+
+	action, hasAction := eventAction(e)
+
+	if len(hook.AllowEvent) != 0 {
+		allowed := false
+		for _, allowedEvent := range hook.AllowEvent {
+			allowedType := allowedEvent
+			allowedAction := ""
+			if dot := strings.IndexByte(allowedEvent, '.'); dot != -1 {
+				allowedType = allowedEvent[:dot]
+				allowedAction = allowedEvent[dot+1:]
+			}
+
+			if allowedType == eventType &&
+				(allowedAction == "" || (hasAction && allowedAction == action)) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			if hasAction {
+				glog.Warningf("Hook %s got disallowed event type %s.%s\n", hook.Url, eventType, action)
+			} else {
+				glog.Warningf("Hook %s got disallowed event type %s\n", hook.Url, eventType)
+			}
+			return false
+		}
+	}
+
+	if len(hook.AllowAction) != 0 {
+		allowed := false
+		if hasAction {
+			for _, allowedAction := range hook.AllowAction {
+				if allowedAction == action {
+					allowed = true
+					break
+				}
+			}
+		}
+
+		if !allowed {
+			// Like branches, there's no way to tell GitHub or GitLab to only
+			// send certain actions, so this isn't a warning.
+			glog.Infof("Hook %s called for ignored action %q\n", hook.Url, action)
+			return false
+		}
+	}
+
+	return true
+}
+
+// allowRepo checks the event's repository against AllowRepos.
+func (hook *Hook) allowRepo(e Event) bool {
+	if len(hook.allowRepos) == 0 {
+		return true
+	}
+
+	repo := e.RepoName()
+	if repo == "" || !hook.allowRepos.MatchAny(repo) {
+		glog.Infof("Hook %s called for ignored repository %q\n", hook.Url, repo)
+		return false
+	}
+
+	return true
+}
+
+// isZeroSHA returns true for the all-zero SHA that GitLab uses for the
+// before or after commit when a branch is created or deleted.
+func isZeroSHA(sha string) bool {
+	return sha != "" && strings.Trim(sha, "0") == ""
+}
+
+// pushState returns whether a push created, deleted, or force-pushed its
+// ref. GitHub gives these directly. For GitLab, created and deleted are
+// inferred from the before and after SHAs, and forced is always false.
+// The last return value is false if the event isn't a push.
+func pushState(e Event) (created, deleted, forced, ok bool) {
+	if _, isBool := e["created"].(bool); isBool {
+		created, _ = e["created"].(bool)
+		deleted, _ = e["deleted"].(bool)
+		forced, _ = e["forced"].(bool)
+		return created, deleted, forced, true
+	}
+
+	before, hasBefore := e["before"].(string)
+	after, hasAfter := e["after"].(string)
+	if !hasBefore || !hasAfter {
+		return false, false, false, false
+	}
+
+	return isZeroSHA(before), isZeroSHA(after), false, true
+}
+
+// allowPushState applies the OnCreated, OnDeleted, and OnForced options.
+func (hook *Hook) allowPushState(e Event) bool {
+	if hook.OnCreated == "" && hook.OnDeleted == "" && hook.OnForced == "" {
+		return true
+	}
+
+	created, deleted, forced, ok := pushState(e)
+
+	checks := []struct {
+		name   string
+		option string
+		state  bool
+	}{
+		{"created", hook.OnCreated, created},
+		{"deleted", hook.OnDeleted, deleted},
+		{"forced", hook.OnForced, forced},
+	}
+
+	for _, check := range checks {
+		if check.option == "only" && (!ok || !check.state) {
+			glog.Infof("Hook %s only runs for %s refs\n", hook.Url, check.name)
+			return false
+		}
+
+		if check.option == "deny" && ok && check.state {
+			glog.Infof("Hook %s called for %s ref, ignoring\n", hook.Url, check.name)
+			return false
+		}
+	}
+
+	return true
+}
+
+// allowRef checks the event's ref against the branch and tag filters.
+func (hook *Hook) allowRef(e Event) bool {
+	if len(hook.allowBranches) == 0 && len(hook.allowTags) == 0 &&
+		len(hook.denyBranches) == 0 {
+		return true
+	}
+
+	ref, ok := e["ref"].(string)
+	if !ok {
+		if len(hook.allowBranches) == 0 && len(hook.allowTags) == 0 {
+			// Only DenyBranches is set, and this event isn't for a branch.
+			return true
+		}
+		glog.Warningf("Received non-string ref type %T: %v", e["ref"], e["ref"])
+		return false
+	}
+
+	if strings.HasPrefix(ref, "refs/tags/") {
+		tag := ref[len("refs/tags/"):]
+		if len(hook.allowBranches) == 0 && len(hook.allowTags) == 0 {
+			return true
+		}
+
+		if !hook.allowTags.MatchAny(tag) {
+			glog.Infof("Hook %s called for ignored tag %s\n", hook.Url, tag)
+			return false
+		}
+		return true
+	}
+
+	// Strip off refs/heads, if present.
+	branch := strings.TrimPrefix(ref, "refs/heads/")
+
+	if hook.denyBranches.MatchAny(branch) {
+		glog.Infof("Hook %s called for denied branch %s\n", hook.Url, branch)
+		return false
+	}
+
+	if (len(hook.allowBranches) != 0 || len(hook.allowTags) != 0) &&
+		!hook.allowBranches.MatchAny(branch) {
+		// This is just an Info, not a warning, since there's no way
+		// to configure Github or Gitlab to only send events for certain
+		// branches.
+		glog.Infof("Hook %s called for ignored branch %s\n", hook.Url, branch)
+		return false
+	}
+
+	return true
+}
+
+// allowFiles checks a list of changed files against the path filters. At
+// least one file must match AllowPaths, if given, without matching
+// IgnorePaths. If found is false, there's no information about which files
+// changed, so only hooks without AllowPaths are allowed.
+func (hook *Hook) allowFiles(files []string, found bool) bool {
+	if len(hook.allowPaths) == 0 && len(hook.ignorePaths) == 0 {
+		return true
+	}
+
+	if !found {
+		if len(hook.allowPaths) != 0 {
+			glog.Infof("Hook %s called for event with no changed files\n", hook.Url)
+			return false
+		}
+		return true
+	}
+
+	if len(hook.allowPaths) == 0 && len(files) == 0 {
+		return true
+	}
+
+	for _, file := range files {
+		if hook.ignorePaths.MatchAny(file) {
+			continue
+		}
+		if len(hook.allowPaths) == 0 || hook.allowPaths.MatchAny(file) {
+			return true
+		}
+	}
+
+	glog.Infof("Hook %s called with no matching changed files\n", hook.Url)
+	return false
+}
+
+// stringField follows a path of keys through nested objects, returning the
+// string at the end if there is one.
+func stringField(obj map[string]interface{}, path ...string) string {
+	for i, key := range path {
+		if i == len(path)-1 {
+			s, _ := obj[key].(string)
+			return s
+		}
+
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		obj = next
+	}
+	return ""
+}
+
+func (hook *Hook) ignoredActor(names ...string) string {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		for _, actor := range hook.IgnoreActors {
+			if name == actor {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// skipCommit returns a reason to skip the commit, or an empty string if it
+// shouldn't be skipped.
+func (hook *Hook) skipCommit(c map[string]interface{}) string {
+	message := stringField(c, "message")
+	for _, re := range hook.skipMessages {
+		if re.MatchString(message) {
+			return fmt.Sprintf("message matches %q", re.String())
+		}
+	}
+
+	actor := hook.ignoredActor(
+		stringField(c, "author", "username"),
+		stringField(c, "author", "name"),
+		stringField(c, "author", "email"),
+		stringField(c, "committer", "username"),
+	)
+	if actor != "" {
+		return fmt.Sprintf("ignored author %s", actor)
+	}
+
+	return ""
+}
+
+// headCommit returns the commit that the ref now points to.
+func headCommit(e Event) map[string]interface{} {
+	commits := e.Commits()
+	after, _ := e["after"].(string)
+	for _, generic := range commits {
+		if c, ok := generic.(map[string]interface{}); ok && after != "" &&
+			stringField(c, "id") == after {
+			return c
+		}
+	}
+
+	if head, ok := e["head_commit"].(map[string]interface{}); ok {
+		return head
+	}
+
+	// GitLab lists commits oldest first.
+	if len(commits) != 0 {
+		c, _ := commits[len(commits)-1].(map[string]interface{})
+		return c
+	}
+
+	return nil
+}
+
+// skipEvent checks the whole event against IgnoreActors, and unless the
+// hook runs per commit, checks the commits against SkipIfMessageMatches
+// and IgnoreActors too.
+func (hook *Hook) skipEvent(e Event) bool {
+	if len(hook.skipMessages) == 0 && len(hook.IgnoreActors) == 0 {
+		return false
+	}
+
+	actor := hook.ignoredActor(
+		stringField(e, "pusher", "name"),
+		stringField(e, "sender", "login"),
+		stringField(e, "user_username"),
+		stringField(e, "user_name"),
+	)
+	if actor != "" {
+		glog.Infof("Hook %s skipping event from ignored actor %s\n", hook.Url, actor)
+		return true
+	}
+
+	if hook.PerCommit {
+		return false
+	}
+
+	if hook.SkipCommits == "all" {
+		commits := e.Commits()
+		if len(commits) == 0 {
+			return false
+		}
+
+		for _, generic := range commits {
+			c, ok := generic.(map[string]interface{})
+			if !ok || hook.skipCommit(c) == "" {
+				return false
+			}
+		}
+
+		glog.Infof("Hook %s skipping event, all commits matched skip rules\n", hook.Url)
+		return true
+	}
+
+	head := headCommit(e)
+	if head == nil {
+		return false
+	}
+
+	if reason := hook.skipCommit(head); reason != "" {
+		glog.Infof("Hook %s skipping event, head commit %s\n", hook.Url, reason)
+		return true
+	}
+	return false
+}
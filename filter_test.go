@@ -0,0 +1,270 @@
+package main
+
+import (
+	"testing"
+)
+
+type refTest struct {
+	Ref     string
+	Allowed bool
+}
+
+func testRefs(t *testing.T, hook *Hook, tests []refTest) {
+	err := hook.CompileFilters()
+	if err != nil {
+		t.Fatal("Failed compiling filters:", err)
+	}
+
+	for _, test := range tests {
+		e := Event{"ref": test.Ref}
+		if hook.allowRef(e) != test.Allowed {
+			t.Errorf("Ref %s: expected allowed=%v", test.Ref, test.Allowed)
+		}
+	}
+}
+
+func TestAllowRef(t *testing.T) {
+	testRefs(t, &Hook{}, []refTest{
+		refTest{"refs/heads/master", true},
+		refTest{"refs/tags/v1.2", true},
+	})
+
+	testRefs(t, &Hook{AllowBranches: []string{"master", "release/*"}}, []refTest{
+		refTest{"refs/heads/master", true},
+		refTest{"master", true},
+		refTest{"refs/heads/release/1.2", true},
+		refTest{"refs/heads/feature", false},
+		refTest{"refs/tags/v1.2", false},
+	})
+
+	testRefs(t, &Hook{AllowTags: []string{"re:^v[0-9]+\\."}}, []refTest{
+		refTest{"refs/heads/master", false},
+		refTest{"refs/tags/v1.2", true},
+		refTest{"refs/tags/nightly", false},
+	})
+
+	testRefs(t, &Hook{DenyBranches: []string{"wip/**"}}, []refTest{
+		refTest{"refs/heads/master", true},
+		refTest{"refs/heads/wip/abc", false},
+		refTest{"refs/tags/wip/abc", true},
+	})
+
+	testRefs(t, &Hook{AllowBranches: []string{"**"}, DenyBranches: []string{"gh-pages"}}, []refTest{
+		refTest{"refs/heads/master", true},
+		refTest{"refs/heads/gh-pages", false},
+	})
+}
+
+func TestAllowFiles(t *testing.T) {
+	e, err := NewEvent([]byte(githubPush), "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type pathTest struct {
+		Allow   []string
+		Ignore  []string
+		Allowed bool
+	}
+
+	tests := []pathTest{
+		pathTest{nil, nil, true},
+		pathTest{[]string{"*.go"}, nil, true},
+		pathTest{[]string{"services/api/**"}, nil, false},
+		pathTest{nil, []string{"*.go"}, false},
+		pathTest{nil, []string{"*.md"}, true},
+		pathTest{[]string{"**"}, []string{"webhook.go"}, false},
+	}
+
+	for _, test := range tests {
+		hook := &Hook{AllowPaths: test.Allow, IgnorePaths: test.Ignore}
+		if err := hook.CompileFilters(); err != nil {
+			t.Fatal(err)
+		}
+
+		if hook.allowFiles(e.ChangedFiles()) != test.Allowed {
+			t.Errorf("AllowPaths %v, IgnorePaths %v: expected allowed=%v",
+				test.Allow, test.Ignore, test.Allowed)
+		}
+	}
+
+	// GitLab pushes don't list files, so AllowPaths can't match.
+	gitlab, err := NewEvent([]byte(gitlabPush), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := &Hook{AllowPaths: []string{"**"}}
+	hook.CompileFilters()
+	if hook.allowFiles(gitlab.ChangedFiles()) {
+		t.Error("Event without file lists was allowed")
+	}
+}
+
+func TestAllowEvent(t *testing.T) {
+	gitlabIssueEvent, err := NewEvent([]byte(gitlabIssue), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sample issue doesn't have an action.
+	gitlabIssueEvent["object_attributes"].(map[string]interface{})["action"] = "open"
+	delete(gitlabIssueEvent, "action")
+
+	closedPR := Event{"type": "pull_request", "action": "closed"}
+	openedPR := Event{"type": "pull_request", "action": "opened"}
+	push := Event{"type": "push"}
+
+	type eventTest struct {
+		Hook    *Hook
+		Event   Event
+		Allowed bool
+	}
+
+	tests := []eventTest{
+		eventTest{&Hook{}, push, true},
+		eventTest{&Hook{AllowEvent: []string{"push"}}, push, true},
+		eventTest{&Hook{AllowEvent: []string{"push"}}, closedPR, false},
+		eventTest{&Hook{AllowEvent: []string{"pull_request"}}, closedPR, true},
+		eventTest{&Hook{AllowEvent: []string{"pull_request.closed"}}, closedPR, true},
+		eventTest{&Hook{AllowEvent: []string{"pull_request.closed"}}, openedPR, false},
+		eventTest{&Hook{AllowEvent: []string{"pull_request.closed", "push"}}, push, true},
+		eventTest{&Hook{AllowAction: []string{"opened"}}, openedPR, true},
+		eventTest{&Hook{AllowAction: []string{"opened"}}, closedPR, false},
+		eventTest{&Hook{AllowAction: []string{"opened"}}, push, false},
+		eventTest{&Hook{AllowAction: []string{"open"}}, gitlabIssueEvent, true},
+		eventTest{&Hook{AllowEvent: []string{"issue.open"}}, gitlabIssueEvent, true},
+	}
+
+	for i, test := range tests {
+		if test.Hook.allowEvent(test.Event) != test.Allowed {
+			t.Errorf("Test %d: expected allowed=%v", i, test.Allowed)
+		}
+	}
+}
+
+func TestSkipEvent(t *testing.T) {
+	github, err := NewEvent([]byte(githubPush), "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gitlab, err := NewEvent([]byte(gitlabPush), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type skipTest struct {
+		Hook  *Hook
+		Event Event
+		Skip  bool
+	}
+
+	tests := []skipTest{
+		skipTest{&Hook{}, github, false},
+		skipTest{&Hook{SkipIfMessageMatches: []string{`\[skip deploy\]`}}, github, false},
+		skipTest{&Hook{SkipIfMessageMatches: []string{`(?i)current directory`}}, github, true},
+		skipTest{&Hook{IgnoreActors: []string{"dimfeld"}}, github, true},
+		skipTest{&Hook{IgnoreActors: []string{"release-bot"}}, github, false},
+		// The head commit is "fixed readme".
+		skipTest{&Hook{SkipIfMessageMatches: []string{"readme"}}, gitlab, true},
+		skipTest{&Hook{SkipIfMessageMatches: []string{"readme"}, SkipCommits: "all"}, gitlab, false},
+		skipTest{&Hook{SkipIfMessageMatches: []string{"readme", "Catalan"}, SkipCommits: "all"}, gitlab, true},
+		skipTest{&Hook{IgnoreActors: []string{"John Smith"}}, gitlab, true},
+		// In PerCommit mode, only the pusher is checked for the whole event.
+		skipTest{&Hook{SkipIfMessageMatches: []string{"readme"}, PerCommit: true}, gitlab, false},
+	}
+
+	for i, test := range tests {
+		if err := test.Hook.CompileFilters(); err != nil {
+			t.Fatal(err)
+		}
+
+		if test.Hook.skipEvent(test.Event) != test.Skip {
+			t.Errorf("Test %d: expected skip=%v", i, test.Skip)
+		}
+	}
+}
+
+func TestAllowPushState(t *testing.T) {
+	github, err := NewEvent([]byte(githubPush), "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	githubDelete := Event{"created": false, "deleted": true, "forced": false}
+	gitlabCreate := Event{
+		"before": "0000000000000000000000000000000000000000",
+		"after":  "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+	}
+	gitlabDelete := Event{
+		"before": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+		"after":  "0000000000000000000000000000000000000000",
+	}
+	issue := Event{"type": "issues"}
+
+	type stateTest struct {
+		Hook    *Hook
+		Event   Event
+		Allowed bool
+	}
+
+	tests := []stateTest{
+		stateTest{&Hook{}, githubDelete, true},
+		stateTest{&Hook{OnDeleted: "deny"}, github, true},
+		stateTest{&Hook{OnDeleted: "deny"}, githubDelete, false},
+		stateTest{&Hook{OnDeleted: "deny"}, gitlabDelete, false},
+		stateTest{&Hook{OnDeleted: "deny"}, issue, true},
+		stateTest{&Hook{OnDeleted: "only"}, githubDelete, true},
+		stateTest{&Hook{OnDeleted: "only"}, github, false},
+		stateTest{&Hook{OnDeleted: "only"}, issue, false},
+		stateTest{&Hook{OnCreated: "only"}, gitlabCreate, true},
+		stateTest{&Hook{OnCreated: "only"}, gitlabDelete, false},
+		stateTest{&Hook{OnForced: "deny"}, gitlabCreate, true},
+	}
+
+	for i, test := range tests {
+		if err := test.Hook.CompileFilters(); err != nil {
+			t.Fatal(err)
+		}
+
+		if test.Hook.allowPushState(test.Event) != test.Allowed {
+			t.Errorf("Test %d: expected allowed=%v", i, test.Allowed)
+		}
+	}
+
+	if err := (&Hook{OnForced: "never"}).CompileFilters(); err == nil {
+		t.Error("Expected error for bad OnForced value")
+	}
+}
+
+func TestAllowRepo(t *testing.T) {
+	e := Event{"repository": map[string]interface{}{"full_name": "myorg/api"}}
+
+	type repoTest struct {
+		Repos   []string
+		Allowed bool
+	}
+
+	tests := []repoTest{
+		repoTest{nil, true},
+		repoTest{[]string{"myorg/*"}, true},
+		repoTest{[]string{"otherorg/*", "myorg/api"}, true},
+		repoTest{[]string{"myorg/web"}, false},
+	}
+
+	for _, test := range tests {
+		hook := &Hook{AllowRepos: test.Repos}
+		if err := hook.CompileFilters(); err != nil {
+			t.Fatal(err)
+		}
+
+		if hook.allowRepo(e) != test.Allowed {
+			t.Errorf("AllowRepos %v: expected allowed=%v", test.Repos, test.Allowed)
+		}
+	}
+
+	hook := &Hook{AllowRepos: []string{"**"}}
+	hook.CompileFilters()
+	if hook.allowRepo(Event{}) {
+		t.Error("Event without a repository was allowed")
+	}
+}
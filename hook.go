@@ -7,6 +7,7 @@ import (
 	"github.com/dimfeld/glog"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 	"text/template"
 	"time"
@@ -22,6 +23,48 @@ var templateFuncs = template.FuncMap{
 		}
 		return string(result)
 	},
+
+	// These are mostly useful in When conditions.
+	"contains":  strings.Contains,
+	"hasPrefix": strings.HasPrefix,
+	"hasSuffix": strings.HasSuffix,
+	"matches": func(pattern string, s string) (bool, error) {
+		return regexp.MatchString(pattern, s)
+	},
+	// in returns true if any item in the list is equal to value.
+	"in": func(list interface{}, value interface{}) bool {
+		items, _ := list.([]interface{})
+		for _, item := range items {
+			if fmt.Sprint(item) == fmt.Sprint(value) {
+				return true
+			}
+		}
+		return false
+	},
+	// pluck returns the given key from each object in a list, such as
+	// the names from a list of labels.
+	"pluck": func(key string, list interface{}) []interface{} {
+		items, _ := list.([]interface{})
+		result := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			if m, ok := item.(map[string]interface{}); ok {
+				result = append(result, m[key])
+			}
+		}
+		return result
+	},
+}
+
+// A Stdin value of stdinRawBody sends the request body to the command
+// without any template processing.
+const stdinRawBody = "@body"
+
+// commandTemplate holds the parsed templates for a single command.
+type commandTemplate struct {
+	args      []*template.Template
+	when      *template.Template
+	stdin     *template.Template
+	stdinBody bool
 }
 
 func createTemplate(source string) (*template.Template, error) {
@@ -29,21 +72,78 @@ func createTemplate(source string) (*template.Template, error) {
 	return template.New("tmpl").Funcs(templateFuncs).Parse(source)
 }
 
-// CreateTemplates parses the Commands array into templates.
+// AllCommands returns the commands from the Commands list followed by
+// those from the Command tables.
+func (hook *Hook) AllCommands() []*Command {
+	commands := make([]*Command, 0, len(hook.Commands)+len(hook.Command))
+	for _, args := range hook.Commands {
+		commands = append(commands, &Command{Args: args})
+	}
+	return append(commands, hook.Command...)
+}
+
+// CreateTemplates parses the commands into templates.
 func (hook *Hook) CreateTemplates() error {
 	var err error
-	hook.cmdTemplate = make([][]*template.Template, len(hook.Commands))
-	for i, cmdList := range hook.Commands {
-		hook.cmdTemplate[i] = make([]*template.Template, len(cmdList))
 
-		for j, cmd := range cmdList {
+	if !validEnvMode(hook.EnvMode) {
+		return fmt.Errorf("EnvMode must be \"merge\", \"replace\", or \"allowlist\", not %q", hook.EnvMode)
+	}
+
+	switch hook.PayloadFile {
+	case "", "body", "event", "both":
+	default:
+		return fmt.Errorf("PayloadFile must be \"body\", \"event\", or \"both\", not %q", hook.PayloadFile)
+	}
+
+	commands := hook.AllCommands()
+	hook.cmdTemplate = make([]*commandTemplate, len(commands))
+	for i, command := range commands {
+		if len(command.Args) == 0 {
+			hook.cmdTemplate = nil
+			return fmt.Errorf("Command %d has no arguments", i)
+		}
+
+		t := &commandTemplate{
+			args: make([]*template.Template, len(command.Args)),
+		}
+
+		for j, arg := range command.Args {
+			t.args[j], err = createTemplate(arg)
+			if err != nil {
+				hook.cmdTemplate = nil
+				return err
+			}
+		}
+
+		if command.When != "" {
+			t.when, err = createTemplate(command.When)
+			if err != nil {
+				hook.cmdTemplate = nil
+				return err
+			}
+		}
 
-			hook.cmdTemplate[i][j], err = createTemplate(cmd)
+		if command.Stdin == stdinRawBody {
+			t.stdinBody = true
+		} else if command.Stdin != "" {
+			t.stdin, err = createTemplate(command.Stdin)
 			if err != nil {
 				hook.cmdTemplate = nil
 				return err
 			}
 		}
+
+		hook.cmdTemplate[i] = t
+	}
+
+	if hook.When != "" {
+		hook.whenTemplate, err = createTemplate(hook.When)
+		if err != nil {
+			return err
+		}
+	} else {
+		hook.whenTemplate = nil
 	}
 
 	if len(hook.Env) != 0 {
@@ -70,98 +170,175 @@ func (hook *Hook) CreateTemplates() error {
 	return nil
 }
 
-// Execute a hook with the given event.
-func (hook *Hook) Execute(e Event) {
-	if len(hook.AllowEvent) != 0 {
-		eventType, ok := e["type"].(string)
-		if !ok {
-			glog.Warningf("Received non-string event type %T: %v", eventType, eventType)
-			return
-		}
+// evalCondition runs a When template. The condition passes only if the
+// template renders "true", ignoring surrounding whitespace.
+func evalCondition(t *template.Template, e Event) (bool, error) {
+	if t == nil {
+		return true, nil
+	}
 
-		allowed := false
-		for _, allowedEvent := range hook.AllowEvent {
-			if allowedEvent == eventType {
-				allowed = true
-				break
-			}
+	buf := &bytes.Buffer{}
+	err := t.Execute(buf, e)
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(buf.String()) == "true", nil
+}
+
+// checkWhen evaluates the hook's When condition.
+func (hook *Hook) checkWhen(e Event) bool {
+	ok, err := evalCondition(hook.whenTemplate, e)
+	if err != nil {
+		glog.Warningf("Hook %s failed evaluating When condition: %s\n", hook.Url, err)
+		return false
+	}
+
+	if !ok {
+		glog.Infof("Hook %s When condition was not met\n", hook.Url)
+	}
+	return ok
+}
+
+// Decision records whether a hook will run for an event, and if not, why.
+// It is returned to the sender as JSON.
+type Decision struct {
+	Hook      string `json:"hook"`
+	Triggered bool   `json:"triggered"`
+	Reason    string `json:"reason,omitempty"`
+
+	// For PerCommit hooks, the commits that passed the filters.
+	commits []map[string]interface{}
+	// The request body, for commands that read it on stdin.
+	body []byte
+}
+
+func (hook *Hook) filtered(reason string) *Decision {
+	return &Decision{Hook: hook.Url, Reason: reason}
+}
+
+// Filter checks the event against all of the hook's filters.
+func (hook *Hook) Filter(e Event) *Decision {
+	if !hook.allowEvent(e) {
+		return hook.filtered("event type or action not allowed")
+	}
+
+	if !hook.allowRepo(e) {
+		return hook.filtered("repository not allowed")
+	}
+
+	if !hook.allowRef(e) {
+		return hook.filtered("branch or tag not allowed")
+	}
+
+	if !hook.allowPushState(e) {
+		return hook.filtered("ref creation, deletion, or force-push not allowed")
+	}
+
+	if hook.skipEvent(e) {
+		return hook.filtered("skipped by commit message or actor")
+	}
+
+	if !hook.PerCommit {
+		if !hook.allowFiles(e.ChangedFiles()) {
+			return hook.filtered("no matching changed files")
 		}
 
-		if !allowed {
-			glog.Warningf("Hook %s got disallowed event type %s\n", hook.Url, eventType)
-			return
+		if !hook.checkWhen(e) {
+			return hook.filtered("When condition not met")
 		}
+
+		return &Decision{Hook: hook.Url, Triggered: true}
 	}
 
-	if len(hook.AllowBranches) != 0 {
-		ref, ok := e["ref"].(string)
+	commits := make([]map[string]interface{}, 0)
+	for _, generic := range e.Commits() {
+		c, ok := generic.(map[string]interface{})
 		if !ok {
-			glog.Warningf("Received non-string ref type %T: %v", ref, ref)
-			return
+			glog.Errorf("Commit had type %T", generic)
+			continue
 		}
 
-		// Strip off refs/heads, if present.
-		prefixString := "refs/heads/"
-		if strings.HasPrefix(ref, prefixString) {
-			ref = ref[len(prefixString):]
+		if !hook.allowFiles(CommitFiles(c)) {
+			continue
 		}
 
-		allowed := false
-		for _, allowedBranch := range hook.AllowBranches {
-			if ref == allowedBranch {
-				allowed = true
-				break
-			}
+		if reason := hook.skipCommit(c); reason != "" {
+			glog.Infof("Hook %s skipping commit %s, %s\n",
+				hook.Url, stringField(c, "id"), reason)
+			continue
 		}
 
-		if !allowed {
-			// This is just an Info, not a warning, since there's no way
-			// to configure Github or Gitlab to only send events for certain
-			// branches.
-			glog.Infof("Hook %s called for ignored branch %s\n", hook.Url, ref)
-			return
+		// Set the current commit to pass to the hook.
+		e["commit"] = c
+
+		if !hook.checkWhen(e) {
+			continue
 		}
+
+		commits = append(commits, c)
 	}
+	delete(e, "commit")
 
-	if hook.PerCommit {
-		commits := e.Commits()
-		if commits != nil {
-			for _, generic := range commits {
-				c, ok := generic.(map[string]interface{})
-				if !ok {
-					glog.Errorf("Commit had type %T", generic)
-					continue
-				}
-
-				// Set the current commit to pass to the hook.
-				e["commit"] = c
-
-				err := hook.processEvent(e)
-				if err != nil {
-					glog.Errorf("Error processing %s: %s\n", hook.Url, err)
-					if glog.V(1) {
-						glog.Info(e)
-					}
-				}
-			}
-		}
-	} else {
-		err := hook.processEvent(e)
-		if err != nil {
-			glog.Errorf("Error processing %s: %s\n", hook.Url, err)
-			if glog.V(1) {
-				glog.Info(e)
-			}
+	if len(commits) == 0 {
+		return hook.filtered("no commits passed the filters")
+	}
+
+	return &Decision{Hook: hook.Url, Triggered: true, commits: commits}
+}
+
+// Execute a hook with the given event.
+func (hook *Hook) Execute(e Event) {
+	d := hook.Filter(e)
+	if d.Triggered {
+		hook.Run(e, d)
+	}
+}
+
+// Run the hook's commands for an event that passed Filter.
+func (hook *Hook) Run(e Event, d *Decision) {
+	if !hook.PerCommit {
+		hook.runEvent(e, d.body)
+		return
+	}
+
+	for _, c := range d.commits {
+		// Set the current commit to pass to the hook.
+		e["commit"] = c
+		hook.runEvent(e, d.body)
+	}
+}
+
+func (hook *Hook) runEvent(e Event, body []byte) {
+	err := hook.processEvent(e, body)
+	if err != nil {
+		glog.Errorf("Error processing %s: %s\n", hook.Url, redact(err.Error()))
+		if glog.V(1) {
+			glog.Info(redact(fmt.Sprint(e)))
 		}
 	}
 }
 
-func (hook *Hook) processEvent(e Event) error {
+func (hook *Hook) processEvent(e Event, body []byte) error {
 	var err error
-	cmds := make([][]string, len(hook.cmdTemplate))
+	cmds := make([][]string, 0, len(hook.cmdTemplate))
+	stdins := make([][]byte, 0, len(hook.cmdTemplate))
 	env := make([]string, len(hook.envTemplate))
 	dir := ""
 
+	runID := newRunID()
+	unwebhookData(e)["run_id"] = runID
+
+	// The files are removed however processEvent returns, including when a
+	// command times out.
+	if hook.PayloadFile != "" {
+		payloadFiles, err := hook.writePayloadFiles(e, body)
+		if err != nil {
+			return err
+		}
+		defer removePayloadFiles(e, payloadFiles)
+	}
+
 	if hook.dirTemplate != nil {
 		buf := &bytes.Buffer{}
 		err = hook.dirTemplate.Execute(buf, e)
@@ -182,21 +359,48 @@ func (hook *Hook) processEvent(e Event) error {
 		}
 	}
 
+	extraEnv := append(hook.standardEnv(e, runID), payloadEnv(e)...)
+	env = hook.buildEnv(env, extraEnv)
+
 	for i, t := range hook.cmdTemplate {
-		cmds[i], err = hook.processCommand(e, t)
+		run, err := evalCondition(t.when, e)
+		if err != nil {
+			return fmt.Errorf("Command %d When condition: %s", i, err)
+		}
+		if !run {
+			glog.Infof("Hook %s skipping command %d, When condition was not met\n",
+				hook.Url, i)
+			continue
+		}
+
+		args, err := hook.processCommand(e, t.args)
 		if err != nil {
 			return err
 		}
 
-		execPath, err := exec.LookPath(cmds[i][0])
+		execPath, err := exec.LookPath(args[0])
 		if err != nil {
-			return fmt.Errorf("Executable %s %s", cmds[i][0], err)
+			return fmt.Errorf("Executable %s %s", args[0], err)
+		}
+		args[0] = execPath
+		cmds = append(cmds, args)
+
+		var stdin []byte
+		if t.stdinBody {
+			stdin = body
+		} else if t.stdin != nil {
+			buf := &bytes.Buffer{}
+			err = t.stdin.Execute(buf, e)
+			if err != nil {
+				return fmt.Errorf("Command %d Stdin: %s", i, err)
+			}
+			stdin = buf.Bytes()
 		}
-		cmds[i][0] = execPath
+		stdins = append(stdins, stdin)
 	}
 
-	for _, cmd := range cmds {
-		err := hook.runCommand(cmd, env, dir)
+	for i, cmd := range cmds {
+		err := hook.runCommand(cmd, env, dir, stdins[i])
 		if err != nil {
 			return err
 		}
@@ -222,20 +426,31 @@ func (hook *Hook) processCommand(e Event, templateList []*template.Template) ([]
 	return cmdList, nil
 }
 
-func (hook *Hook) runCommand(args []string, env []string, dir string) error {
-	glog.Infoln("Running", args)
-	cmd := exec.Command(args[0], args[1:]...)
+func (hook *Hook) runCommand(args []string, env []string, dir string, stdin []byte) error {
+	glog.Infoln("Running", redact(fmt.Sprint(args)))
+	cmd, err := hook.Limits.command(args)
+	if err != nil {
+		return fmt.Errorf("Failed applying limits to command %v: %s", args, err)
+	}
 	if len(env) != 0 {
 		cmd.Env = env
 	}
 	cmd.Dir = dir
+	hook.setRunAs(cmd)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
 	// TODO Make these redirectable
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Command %v failed to start: %s", args, err)
+	}
+
 	done := make(chan int, 1)
 
-	cmd.Start()
 	go func() {
 		cmd.Wait()
 		done <- 1
@@ -246,6 +461,15 @@ func (hook *Hook) runCommand(args []string, env []string, dir string) error {
 	select {
 	case <-done:
 		timer.Stop()
+		if cmd.ProcessState == nil {
+			return nil
+		}
+		if reason := hook.Limits.killReason(cmd.ProcessState); reason != "" {
+			return fmt.Errorf("Command %v %s", args, reason)
+		}
+		if !cmd.ProcessState.Success() {
+			glog.Warningf("Command %v exited with %s\n", redact(fmt.Sprint(args)), cmd.ProcessState)
+		}
 		return nil
 
 	case <-timer.C:
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEvalCondition(t *testing.T) {
+	e := Event{
+		"action": "opened",
+		"labels": []interface{}{
+			map[string]interface{}{"name": "bug"},
+			map[string]interface{}{"name": "deploy"},
+		},
+		"pull_request": map[string]interface{}{
+			"merged": true,
+			"base":   map[string]interface{}{"ref": "main"},
+		},
+	}
+
+	type conditionTest struct {
+		When   string
+		Result bool
+	}
+
+	tests := []conditionTest{
+		conditionTest{`{{ eq .action "opened" }}`, true},
+		conditionTest{`{{ eq .action "closed" }}`, false},
+		conditionTest{`{{ and (eq .action "opened") (in (pluck "name" .labels) "deploy") }}`, true},
+		conditionTest{`{{ in (pluck "name" .labels) "release" }}`, false},
+		conditionTest{`{{ and .pull_request.merged (eq .pull_request.base.ref "main") }}`, true},
+		conditionTest{`{{ matches "^open" .action }}`, true},
+		conditionTest{` true `, true},
+		conditionTest{`yes`, false},
+	}
+
+	for _, test := range tests {
+		tmpl, err := createTemplate(test.When)
+		if err != nil {
+			t.Errorf("Failed parsing %s: %s", test.When, err)
+			continue
+		}
+
+		result, err := evalCondition(tmpl, e)
+		if err != nil {
+			t.Errorf("Failed evaluating %s: %s", test.When, err)
+		} else if result != test.Result {
+			t.Errorf("%s: expected %v", test.When, test.Result)
+		}
+	}
+}
+
+func TestCreateTemplatesError(t *testing.T) {
+	hook := &Hook{
+		Commands: [][]string{[]string{"echo"}},
+		Command:  []*Command{&Command{Args: []string{"echo"}, When: "{{ .action "}},
+	}
+
+	if err := hook.CreateTemplates(); err == nil {
+		t.Error("Expected error from bad When template")
+	}
+
+	hook = &Hook{When: "{{ eq .action }"}
+	if err := hook.CreateTemplates(); err == nil {
+		t.Error("Expected error from bad hook When template")
+	}
+}
+
+func TestCommandStdin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unwebhook-stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hook := &Hook{
+		Url:     "/test",
+		Dir:     dir,
+		Timeout: 5,
+		Command: []*Command{
+			&Command{Args: []string{"sh", "-c", "cat > body.txt"}, Stdin: "@body"},
+			&Command{Args: []string{"sh", "-c", "cat > type.txt"}, Stdin: "{{ .type }}"},
+		},
+	}
+
+	if err := hook.CreateTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"action": "opened"}`)
+	err = hook.processEvent(Event{"type": "issues"}, body)
+	if err != nil {
+		t.Fatal("Failed running commands:", err)
+	}
+
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "body.txt")); string(data) != string(body) {
+		t.Errorf("Expected raw body on stdin, got %q", data)
+	}
+
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "type.txt")); string(data) != "issues" {
+		t.Errorf("Expected rendered template on stdin, got %q", data)
+	}
+}
+
+func TestPayloadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unwebhook-payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hook := &Hook{
+		Url:         "/test",
+		Dir:         dir,
+		Timeout:     5,
+		PayloadFile: "body",
+		Commands: [][]string{
+			// Commands have environment variables expanded when they're
+			// loaded, so printenv is needed to see the command's environment.
+			[]string{"sh", "-c", "cp `printenv UNWEBHOOK_PAYLOAD` body.txt"},
+			[]string{"sh", "-c", "echo -n {{ .unwebhook.payload_file }} > path.txt"},
+		},
+	}
+
+	if err := hook.CreateTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"action": "opened"}`)
+	e := Event{"type": "issues"}
+	err = hook.processEvent(e, body)
+	if err != nil {
+		t.Fatal("Failed running commands:", err)
+	}
+
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "body.txt")); string(data) != string(body) {
+		t.Errorf("Expected body in payload file, got %q", data)
+	}
+
+	path, _ := ioutil.ReadFile(filepath.Join(dir, "path.txt"))
+	if len(path) == 0 {
+		t.Fatal("Payload file path was not available to templates")
+	}
+	if _, err := os.Stat(string(path)); !os.IsNotExist(err) {
+		t.Errorf("Payload file %s was not removed", path)
+	}
+	if _, ok := e["unwebhook"].(serverData)["payload_file"]; ok {
+		t.Error("payload_file was left in the event")
+	}
+}
+
+func TestPayloadFileBoth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unwebhook-payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hook := &Hook{
+		Url:         "/test",
+		Dir:         dir,
+		Timeout:     5,
+		PayloadFile: "both",
+		Commands: [][]string{
+			[]string{"sh", "-c", "cp `printenv UNWEBHOOK_BODY_FILE` body.txt"},
+			[]string{"sh", "-c", "cp {{ .unwebhook.event_file }} event.json"},
+		},
+	}
+
+	if err := hook.CreateTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"action": "opened"}`)
+	e := Event{"type": "issues", "action": "opened"}
+	err = hook.processEvent(e, body)
+	if err != nil {
+		t.Fatal("Failed running commands:", err)
+	}
+
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "body.txt")); string(data) != string(body) {
+		t.Errorf("Expected body in body file, got %q", data)
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "event.json"))
+	event := map[string]interface{}{}
+	if err := json.Unmarshal(data, &event); err != nil || event["type"] != "issues" {
+		t.Errorf("Expected event in event file, got %q", data)
+	}
+
+	for _, key := range []string{"payload_file", "body_file", "event_file"} {
+		if _, ok := e["unwebhook"].(serverData)[key]; ok {
+			t.Errorf("%s was left in the event", key)
+		}
+	}
+}
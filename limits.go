@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+)
+
+// limitsShimArg is the first argument given to the server when it runs
+// itself to apply a hook's limits before running a command.
+const limitsShimArg = "-unwebhook-limits-shim"
+
+// ResourceLimits restricts the resources that a hook's commands can use.
+// Zero values mean no limit. Limits are only supported on Linux.
+type ResourceLimits struct {
+	// Largest virtual memory size of each process, in bytes.
+	AddressSpace uint64
+	// CPU time each process may use, in seconds. The process receives SIGXCPU
+	// when it reaches the limit, and is killed a second later.
+	CPUSeconds uint64
+	// Most file descriptors each process may have open.
+	OpenFiles uint64
+	// Most processes that the command's user may have, across the system.
+	Processes uint64
+
+	// Scheduling priority, from -20 (highest) to 19 (lowest).
+	Nice int
+	// I/O scheduling class, "realtime", "best-effort", or "idle", and the
+	// priority within it, from 0 (highest) to 7 (lowest).
+	IOClass    string
+	IOPriority int
+}
+
+// Enabled returns true if any limit is set.
+func (l ResourceLimits) Enabled() bool {
+	return l.AddressSpace != 0 || l.CPUSeconds != 0 || l.OpenFiles != 0 ||
+		l.Processes != 0 || l.Nice != 0 || l.IOClass != "" || l.IOPriority != 0
+}
+
+// Validate checks that the limits are in range, and that they are supported
+// on this platform.
+func (l ResourceLimits) Validate() error {
+	if !l.Enabled() {
+		return nil
+	}
+
+	if !limitsSupported {
+		return fmt.Errorf("Limits are not supported on this platform")
+	}
+
+	if l.Nice < -20 || l.Nice > 19 {
+		return fmt.Errorf("Nice must be between -20 and 19, not %d", l.Nice)
+	}
+
+	switch l.IOClass {
+	case "", "realtime", "best-effort", "idle":
+	default:
+		return fmt.Errorf("IOClass must be \"realtime\", \"best-effort\", or \"idle\", not %q", l.IOClass)
+	}
+
+	if l.IOPriority < 0 || l.IOPriority > 7 {
+		return fmt.Errorf("IOPriority must be between 0 and 7, not %d", l.IOPriority)
+	}
+
+	if l.IOPriority != 0 && l.IOClass == "" {
+		return fmt.Errorf("IOPriority requires an IOClass")
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+const limitsSupported = true
+
+// The syscall package doesn't define these.
+const (
+	rlimitNproc = 6
+
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+var ioprioClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// command creates the command to run args. If any limits are set, the
+// server runs itself as a shim that applies them and then execs args, so
+// that the limits are in place before the command starts.
+func (l ResourceLimits) command(args []string) (*exec.Cmd, error) {
+	if !l.Enabled() {
+		return exec.Command(args[0], args[1:]...), nil
+	}
+
+	encoded, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+
+	// /proc/self/exe still works if the server's binary has been replaced
+	// since it started.
+	shimArgs := append([]string{limitsShimArg, string(encoded), "--"}, args...)
+	return exec.Command("/proc/self/exe", shimArgs...), nil
+}
+
+// runLimitsShim applies the limits and execs the command, if the server was
+// started as a shim by ResourceLimits.command. Otherwise it returns without
+// doing anything.
+func runLimitsShim() {
+	if len(os.Args) < 5 || os.Args[1] != limitsShimArg || os.Args[3] != "--" {
+		return
+	}
+
+	// Nice and I/O priority belong to the thread, so they must be set on the
+	// thread that calls exec.
+	runtime.LockOSThread()
+
+	args := os.Args[4:]
+	env := os.Environ()
+
+	var l ResourceLimits
+	err := json.Unmarshal([]byte(os.Args[2]), &l)
+	if err == nil {
+		err = l.applySelf()
+	}
+	if err == nil {
+		err = syscall.Exec(args[0], args, env)
+	}
+
+	fmt.Fprintf(os.Stderr, "unwebhook: failed running %s with limits: %s\n", args[0], err)
+	os.Exit(126)
+}
+
+// applySelf sets the limits on the current process, which the command
+// inherits when it is exec'd.
+func (l ResourceLimits) applySelf() error {
+	if l.Nice != 0 {
+		err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, l.Nice)
+		if err != nil {
+			return fmt.Errorf("setting Nice: %s", err)
+		}
+	}
+
+	if l.IOClass != "" {
+		ioprio := ioprioClasses[l.IOClass]<<ioprioClassShift | l.IOPriority
+		_, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(ioprio))
+		if errno != 0 {
+			return fmt.Errorf("setting IOClass: %s", errno)
+		}
+	}
+
+	// The address space limit comes last, since it could stop the shim
+	// itself from allocating memory.
+	rlimits := []struct {
+		name     string
+		resource int
+		limit    syscall.Rlimit
+	}{
+		{"OpenFiles", syscall.RLIMIT_NOFILE, syscall.Rlimit{Cur: l.OpenFiles, Max: l.OpenFiles}},
+		{"Processes", rlimitNproc, syscall.Rlimit{Cur: l.Processes, Max: l.Processes}},
+		// The hard limit is a second later, so that a process that ignores
+		// SIGXCPU is still killed.
+		{"CPUSeconds", syscall.RLIMIT_CPU, syscall.Rlimit{Cur: l.CPUSeconds, Max: l.CPUSeconds + 1}},
+		{"AddressSpace", syscall.RLIMIT_AS, syscall.Rlimit{Cur: l.AddressSpace, Max: l.AddressSpace}},
+	}
+
+	for _, r := range rlimits {
+		if r.limit.Cur == 0 {
+			continue
+		}
+		err := syscall.Setrlimit(r.resource, &r.limit)
+		if err != nil {
+			return fmt.Errorf("setting %s: %s", r.name, err)
+		}
+	}
+
+	return nil
+}
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGABRT: "SIGABRT",
+}
+
+// killReason describes how a limit ended the process, or returns an empty
+// string if it exited on its own. Shells exit with 128 plus the signal
+// number when a command they ran is killed, so those statuses count too.
+func (l ResourceLimits) killReason(state *os.ProcessState) string {
+	if !l.Enabled() {
+		return ""
+	}
+
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return ""
+	}
+
+	var signal syscall.Signal
+	var how string
+	if status.Signaled() {
+		signal = status.Signal()
+		how = "was killed by " + signalNames[signal]
+	} else if status.Exited() && status.ExitStatus() > 128 {
+		signal = syscall.Signal(status.ExitStatus() - 128)
+		how = fmt.Sprintf("exited with status %d, as if a process was killed by %s",
+			status.ExitStatus(), signalNames[signal])
+	} else {
+		return ""
+	}
+
+	// This includes the time of any child processes that the command waited
+	// for.
+	cpuTime := state.UserTime() + state.SystemTime()
+
+	switch signal {
+	case syscall.SIGXCPU:
+		if l.CPUSeconds != 0 {
+			return fmt.Sprintf("%s after exceeding the CPU time limit of %d seconds", how, l.CPUSeconds)
+		}
+
+	case syscall.SIGKILL:
+		if l.CPUSeconds != 0 && cpuTime.Seconds() >= float64(l.CPUSeconds) {
+			return fmt.Sprintf("%s after exceeding the CPU time limit of %d seconds", how, l.CPUSeconds)
+		}
+
+	case syscall.SIGSEGV, syscall.SIGBUS, syscall.SIGABRT:
+		// Running out of memory usually shows up as one of these.
+		if l.AddressSpace != 0 {
+			return fmt.Sprintf("%s, possibly from exceeding the address space limit of %d bytes",
+				how, l.AddressSpace)
+		}
+	}
+
+	return ""
+}
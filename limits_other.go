@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+const limitsSupported = false
+
+func (l ResourceLimits) command(args []string) (*exec.Cmd, error) {
+	return exec.Command(args[0], args[1:]...), nil
+}
+
+func runLimitsShim() {
+}
+
+func (l ResourceLimits) killReason(state *os.ProcessState) string {
+	return ""
+}
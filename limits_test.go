@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// The tests run the test binary as the limits shim.
+	runLimitsShim()
+	os.Exit(m.Run())
+}
+
+func TestValidateLimits(t *testing.T) {
+	type limitsTest struct {
+		Limits ResourceLimits
+		Valid  bool
+	}
+
+	tests := []limitsTest{
+		limitsTest{ResourceLimits{}, true},
+		limitsTest{ResourceLimits{Nice: -21}, false},
+		limitsTest{ResourceLimits{Nice: 20}, false},
+		limitsTest{ResourceLimits{IOClass: "fast"}, false},
+		limitsTest{ResourceLimits{IOClass: "best-effort", IOPriority: 8}, false},
+		limitsTest{ResourceLimits{IOPriority: 3}, false},
+	}
+
+	if limitsSupported {
+		tests = append(tests,
+			limitsTest{ResourceLimits{CPUSeconds: 10, OpenFiles: 256, Nice: 10}, true},
+			limitsTest{ResourceLimits{IOClass: "best-effort", IOPriority: 7}, true},
+			limitsTest{ResourceLimits{IOClass: "idle"}, true},
+		)
+	}
+
+	for _, test := range tests {
+		err := test.Limits.Validate()
+		if test.Valid && err != nil {
+			t.Errorf("%+v: unexpected error %s", test.Limits, err)
+		} else if !test.Valid && err == nil {
+			t.Errorf("%+v: expected an error", test.Limits)
+		}
+	}
+}
+
+func TestLimitsShim(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Limits are only supported on Linux")
+	}
+
+	dir, err := ioutil.TempDir("", "unwebhook-limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "limits.txt")
+
+	// The shell reads its limits as soon as it starts, so this only passes if
+	// they were in place before it did.
+	hook := &Hook{Url: "/test", Timeout: 5, Limits: ResourceLimits{OpenFiles: 64, CPUSeconds: 30, Nice: 5}}
+	err = hook.runCommand([]string{"/bin/sh", "-c", "ulimit -n > " + output + "; ulimit -t >> " + output}, nil, "", nil)
+	if err != nil {
+		t.Fatal("Failed running command:", err)
+	}
+
+	data, _ := ioutil.ReadFile(output)
+	if string(data) != "64\n30\n" {
+		t.Errorf("Expected open files limit 64 and CPU limit 30, got %q", data)
+	}
+}
+
+func TestCPULimitKill(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Limits are only supported on Linux")
+	}
+	if testing.Short() {
+		t.Skip("Uses a few seconds of CPU time")
+	}
+
+	hook := &Hook{Url: "/test", Timeout: 30, Limits: ResourceLimits{CPUSeconds: 1}}
+
+	type killTest struct {
+		Command string
+		Killed  bool
+	}
+
+	tests := []killTest{
+		killTest{"while :; do :; done", true},
+		// The shell reports the killed subshell in its exit status.
+		killTest{"( while :; do :; done ); exit $?", true},
+		killTest{"exit 0", false},
+		killTest{"exit 1", false},
+	}
+
+	for _, test := range tests {
+		err := hook.runCommand([]string{"/bin/sh", "-c", test.Command}, nil, "", nil)
+		killed := err != nil && strings.Contains(err.Error(), "CPU time limit")
+		if killed != test.Killed {
+			t.Errorf("Command %q: expected killed %v, got error %v", test.Command, test.Killed, err)
+		}
+	}
+}
@@ -38,6 +38,32 @@ func (f *ListenFilter) AddString(s string) error {
 	return nil
 }
 
+// Allowed returns true if the filter lets the address through.
+func (f *ListenFilter) Allowed(addr net.IP) bool {
+	// A trie would be better here. But for this program there will rarely
+	// be more than one or two entries so it doesn't really matter.
+
+	found := false
+	for _, net := range f.FilterNet {
+		if net.Contains(addr) {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		for _, filterAddr := range f.FilterAddr {
+			if filterAddr.Equal(addr) {
+				found = true
+				break
+			}
+		}
+	}
+
+	return (found && f.Behavior == WhiteList) ||
+		(!found && f.Behavior == BlackList)
+}
+
 func (f *ListenFilter) Accept() (c net.Conn, err error) {
 	for {
 		c, err = f.Listener.Accept()
@@ -49,29 +75,7 @@ func (f *ListenFilter) Accept() (c net.Conn, err error) {
 		addrStr, _, err = net.SplitHostPort(c.RemoteAddr().String())
 		addr := net.ParseIP(addrStr)
 
-		// A trie would be better here. But for this program there will rarely
-		// be more than one or two entries so it doesn't really matter.
-
-		found := false
-		for _, net := range f.FilterNet {
-			if net.Contains(addr) {
-				found = true
-				break
-			}
-		}
-
-		if !found {
-			for _, filterAddr := range f.FilterAddr {
-				if filterAddr.Equal(addr) {
-					found = true
-					break
-				}
-			}
-		}
-
-		if (found && f.Behavior == WhiteList) ||
-			(!found && f.Behavior == BlackList) {
-
+		if f.Allowed(addr) {
 			// Connection allowed.
 			return
 		}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dimfeld/glog"
+	"github.com/dimfeld/httptreemux"
+	"net"
+	"net/http"
+)
+
+// hookMetrics is the JSON representation of a hook's statistics.
+type hookMetrics struct {
+	Rejections      map[string]uint64 `json:"rejections"`
+	RejectionsTotal uint64            `json:"rejections_total"`
+	RateLimit       *LimiterMetrics   `json:"rate_limit,omitempty"`
+	ClientRateLimit *LimiterMetrics   `json:"client_rate_limit,omitempty"`
+}
+
+// Metrics gathers the statistics for every hook, keyed by hook URL.
+func (c *Config) Metrics() map[string]interface{} {
+	hooks := make(map[string]hookMetrics, len(c.Hook))
+	for _, h := range c.Hook {
+		m := hookMetrics{
+			Rejections:      h.Rejections(),
+			RateLimit:       h.limiter.Metrics(),
+			ClientRateLimit: h.clientLimiter.Metrics(),
+		}
+		for _, count := range m.Rejections {
+			m.RejectionsTotal += count
+		}
+		hooks[h.Url] = m
+	}
+
+	result := map[string]interface{}{
+		"hooks": hooks,
+	}
+
+	if c.limiters != nil {
+		if m := c.limiters.all.Metrics(); m != nil {
+			result["rate_limit"] = m
+		}
+		if m := c.limiters.client.Metrics(); m != nil {
+			result["client_rate_limit"] = m
+		}
+	}
+
+	return result
+}
+
+// LoadMetricsAuth sets up the access controls for MetricsUrl. The
+// credentials are held by a hook that is never routed, so that they can be
+// checked and reloaded in the same way as a hook's.
+func (c *Config) LoadMetricsAuth() error {
+	c.metricsHook = nil
+	c.metricsIps = nil
+	if c.MetricsUrl == "" {
+		return nil
+	}
+
+	if len(c.MetricsAcceptIps) != 0 {
+		c.metricsIps = NewListenFilter(nil, WhiteList)
+		for _, a := range c.MetricsAcceptIps {
+			err := c.metricsIps.AddString(a)
+			if err != nil {
+				return fmt.Errorf("MetricsAcceptIps %q: %s", a, err)
+			}
+		}
+	}
+
+	c.metricsHook = &Hook{
+		Url:        c.MetricsUrl,
+		AuthTokens: c.MetricsAuthTokens,
+		BasicAuth:  c.MetricsBasicAuth,
+	}
+	return c.metricsHook.LoadCredentials()
+}
+
+func metricsHandler(config *Config) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if config.metricsIps != nil && !config.metricsIps.Allowed(net.ParseIP(clientIP(r))) {
+			glog.Warningf("Denied metrics request from %s\n", r.RemoteAddr)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if hook := config.metricsHook; hook != nil && !hook.CheckAuthorization(r) {
+			glog.Warningf("Metrics request from %s had bad credentials\n", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", hook.authChallenge())
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		writeJSON(w, config.Metrics())
+	}
+}
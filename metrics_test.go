@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsAuth(t *testing.T) {
+	config := &Config{
+		MetricsUrl:        "/metrics",
+		MetricsAcceptIps:  []string{"192.0.2.0/24"},
+		MetricsAuthTokens: []Credential{Credential{Value: "metricstoken"}},
+	}
+	if err := config.LoadMetricsAuth(); err != nil {
+		t.Fatal(err)
+	}
+	handler := metricsHandler(config)
+
+	send := func(remoteAddr, token string) int {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.RemoteAddr = remoteAddr
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r, map[string]string{})
+		return w.Code
+	}
+
+	if code := send("198.51.100.1:1234", "metricstoken"); code != http.StatusForbidden {
+		t.Errorf("Disallowed IP: expected 403, got %d", code)
+	}
+	if code := send("192.0.2.1:1234", ""); code != http.StatusUnauthorized {
+		t.Errorf("Missing token: expected 401, got %d", code)
+	}
+	if code := send("192.0.2.1:1234", "metricstoken"); code != http.StatusOK {
+		t.Errorf("Valid request: expected 200, got %d", code)
+	}
+}
+
+func TestCheckRoutes(t *testing.T) {
+	type routeTest struct {
+		Config Config
+		Valid  bool
+	}
+
+	tests := []routeTest{
+		routeTest{Config{Hook: []*Hook{
+			&Hook{Url: "/a"},
+			&Hook{Url: "/a", Methods: []string{"GET"}},
+		}}, true},
+		routeTest{Config{Hook: []*Hook{
+			&Hook{Url: "/a"},
+			&Hook{Url: "/a", Methods: []string{"get", "post"}},
+		}}, false},
+		routeTest{Config{MetricsUrl: "/metrics", Hook: []*Hook{
+			&Hook{Url: "/metrics"},
+		}}, false},
+	}
+
+	for i, test := range tests {
+		err := test.Config.CheckRoutes()
+		if test.Valid && err != nil {
+			t.Errorf("Test %d: unexpected error %s", i, err)
+		} else if !test.Valid && err == nil {
+			t.Errorf("Test %d: expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Pattern matches strings against either a glob or, if the source starts
+// with "re:", a regular expression.
+//
+// In globs, "*" matches any run of characters except "/", "**" matches any
+// run of characters including "/", "?" matches a single character other than
+// "/", and "[...]" matches a character class. Regular expressions are not
+// anchored unless they include ^ or $ themselves.
+type Pattern struct {
+	Source string
+	re     *regexp.Regexp
+}
+
+func CompilePattern(source string) (*Pattern, error) {
+	var expr string
+	if strings.HasPrefix(source, "re:") {
+		expr = source[3:]
+	} else {
+		var err error
+		expr, err = globToRegexp(source)
+		if err != nil {
+			return nil, fmt.Errorf("Bad pattern %q: %s", source, err)
+		}
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("Bad pattern %q: %s", source, err)
+	}
+
+	return &Pattern{Source: source, re: re}, nil
+}
+
+func (p *Pattern) Match(s string) bool {
+	return p.re.MatchString(s)
+}
+
+// globToRegexp converts a glob into an anchored regular expression.
+func globToRegexp(glob string) (string, error) {
+	expr := &strings.Builder{}
+	expr.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// "**/" also matches no directories at all.
+					i++
+					expr.WriteString("(?:.*/)?")
+				} else {
+					expr.WriteString(".*")
+				}
+			} else {
+				expr.WriteString("[^/]*")
+			}
+
+		case '?':
+			expr.WriteString("[^/]")
+
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				return "", fmt.Errorf("unterminated character class")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	expr.WriteString("$")
+	return expr.String(), nil
+}
+
+// PatternList matches if any of its patterns match.
+type PatternList []*Pattern
+
+func CompilePatterns(sources []string) (PatternList, error) {
+	if len(sources) == 0 {
+		return nil, nil
+	}
+
+	list := make(PatternList, len(sources))
+	for i, source := range sources {
+		var err error
+		list[i], err = CompilePattern(source)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (l PatternList) MatchAny(s string) bool {
+	for _, p := range l {
+		if p.Match(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+type patternTest struct {
+	Pattern string
+	Value   string
+	Match   bool
+}
+
+func TestPattern(t *testing.T) {
+	tests := []patternTest{
+		patternTest{"master", "master", true},
+		patternTest{"master", "master2", false},
+		patternTest{"release/*", "release/1.2", true},
+		patternTest{"release/*", "release/1.2/hotfix", false},
+		patternTest{"release/**", "release/1.2/hotfix", true},
+		patternTest{"v?.*", "v1.2", true},
+		patternTest{"v[0-9].*", "va.2", false},
+		patternTest{"v[!0-9]*", "va", true},
+		patternTest{"services/api/**", "services/api/main.go", true},
+		patternTest{"services/api/**", "services/web/main.go", false},
+		patternTest{"**/*.md", "README.md", true},
+		patternTest{"**/*.md", "docs/setup/README.md", true},
+		patternTest{"a.b", "axb", false},
+		patternTest{"re:^feature-[0-9]+$", "feature-12", true},
+		patternTest{"re:^feature-[0-9]+$", "feature-x", false},
+		patternTest{"re:hotfix", "team/hotfix/1", true},
+	}
+
+	for _, test := range tests {
+		p, err := CompilePattern(test.Pattern)
+		if err != nil {
+			t.Errorf("Failed compiling %s: %s", test.Pattern, err)
+			continue
+		}
+
+		if p.Match(test.Value) != test.Match {
+			t.Errorf("Pattern %s on %s: expected match=%v", test.Pattern, test.Value, test.Match)
+		}
+	}
+}
+
+func TestPatternError(t *testing.T) {
+	for _, source := range []string{"v[0-9", "re:(abc"} {
+		if _, err := CompilePattern(source); err == nil {
+			t.Errorf("Expected error compiling %s", source)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dimfeld/glog"
+	"io/ioutil"
+	"os"
+)
+
+// serverData holds the data that the server adds to an event as
+// .unwebhook. It has its own type so that a map with the same key decoded
+// from the request body is never mistaken for it.
+type serverData map[string]interface{}
+
+// unwebhookData returns the event's .unwebhook map, replacing anything else
+// under that key, such as a value sent in the request body.
+func unwebhookData(e Event) serverData {
+	data, ok := e["unwebhook"].(serverData)
+	if !ok {
+		data = serverData{}
+		e["unwebhook"] = data
+	}
+	return data
+}
+
+// writeTempFile writes data to a temporary file that only the server's user,
+// or the hook's User, can read.
+func (hook *Hook) writeTempFile(data []byte) (string, error) {
+	f, err := ioutil.TempFile("", "unwebhook-payload-")
+	if err != nil {
+		return "", err
+	}
+
+	// The commands must be able to read the file when they run as another
+	// user.
+	if hook.runAs != nil {
+		err = f.Chown(int(hook.runAs.uid), int(hook.runAs.gid))
+	}
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("Failed writing payload file: %s", err)
+	}
+
+	return f.Name(), nil
+}
+
+// writePayloadFiles writes the request body, the event, or both to temporary
+// files, and records their paths in the event as .unwebhook.body_file and
+// .unwebhook.event_file. .unwebhook.payload_file is the body file if there
+// is one, and the event file otherwise. The event file is written last, so
+// that it includes the path of the body file.
+func (hook *Hook) writePayloadFiles(e Event, body []byte) ([]string, error) {
+	data := unwebhookData(e)
+	paths := make([]string, 0, 2)
+
+	if hook.PayloadFile == "body" || hook.PayloadFile == "both" {
+		path, err := hook.writeTempFile(body)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+		data["body_file"] = path
+		data["payload_file"] = path
+	}
+
+	if hook.PayloadFile == "event" || hook.PayloadFile == "both" {
+		eventData, err := json.Marshal(e)
+		if err == nil {
+			var path string
+			path, err = hook.writeTempFile(eventData)
+			if err == nil {
+				paths = append(paths, path)
+				data["event_file"] = path
+				if data["payload_file"] == nil {
+					data["payload_file"] = path
+				}
+			}
+		}
+
+		if err != nil {
+			removePayloadFiles(e, paths)
+			return nil, err
+		}
+	}
+
+	return paths, nil
+}
+
+// payloadEnv returns the environment variables that point to the payload
+// files. Variables for files that weren't written are empty.
+func payloadEnv(e Event) []string {
+	data := unwebhookData(e)
+	vars := []struct {
+		name string
+		key  string
+	}{
+		{"UNWEBHOOK_PAYLOAD", "payload_file"},
+		{"UNWEBHOOK_BODY_FILE", "body_file"},
+		{"UNWEBHOOK_EVENT_FILE", "event_file"},
+	}
+
+	env := make([]string, 0, len(vars))
+	for _, v := range vars {
+		path, _ := data[v.key].(string)
+		env = append(env, v.name+"="+path)
+	}
+	return env
+}
+
+// removePayloadFiles deletes the payload files once the hook's commands are
+// done with them.
+func removePayloadFiles(e Event, paths []string) {
+	data := unwebhookData(e)
+	delete(data, "payload_file")
+	delete(data, "body_file")
+	delete(data, "event_file")
+
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil {
+			glog.Errorf("Failed removing payload file %s: %s", path, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimit configures a token bucket. Requests take one token each, and
+// tokens are refilled at PerMinute per minute, up to Burst. If PerMinute is
+// 0, there is no limit.
+type RateLimit struct {
+	PerMinute float64
+	// Defaults to PerMinute, or 1 if PerMinute is less than 1.
+	Burst int
+}
+
+func (l RateLimit) Enabled() bool {
+	return l.PerMinute > 0
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Floor(l.PerMinute))
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the bucket was last used.
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	elapsed := now.Sub(b.last).Minutes()
+	b.tokens = math.Min(limit.burst(), b.tokens+elapsed*limit.PerMinute)
+	b.last = now
+}
+
+// available reports whether the bucket has a token. If not, it returns how
+// long to wait until it will.
+func (b *tokenBucket) available(limit RateLimit, now time.Time) (bool, time.Duration) {
+	b.refill(limit, now)
+	if b.tokens >= 1 {
+		return true, 0
+	}
+
+	minutes := (1 - b.tokens) / limit.PerMinute
+	return false, time.Duration(minutes * float64(time.Minute))
+}
+
+// Limiter applies a rate limit separately for each key. A limiter for a
+// single bucket can just use the same key for everything.
+type Limiter struct {
+	lock      sync.Mutex
+	limit     RateLimit
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	limited   uint64
+}
+
+func NewLimiter(limit RateLimit) *Limiter {
+	if !limit.Enabled() {
+		return nil
+	}
+
+	return &Limiter{
+		limit:   limit,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// prune removes buckets that have refilled completely, since they're the
+// same as a new bucket. The lock must be held.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	for key, b := range l.buckets {
+		b.refill(l.limit, now)
+		if b.tokens >= l.limit.burst() {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// bucket returns the bucket for the key, creating a full one if needed.
+// The lock must be held.
+func (l *Limiter) bucket(key string, now time.Time) *tokenBucket {
+	l.prune(now)
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: l.limit.burst(), last: now}
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// Allow takes a token for the given key. If none is available, it returns
+// false and the time until one will be. A nil Limiter allows everything.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	return allowAll([]limiterKey{{l, key}})
+}
+
+type limiterKey struct {
+	limiter *Limiter
+	key     string
+}
+
+// allowAll takes a token from each limiter for its key, but only if every
+// one of them has a token available, so that a request rejected by one
+// limiter doesn't use up the others. Nil limiters are skipped. Callers must
+// always pass the limiters in the same order, to avoid deadlocks.
+func allowAll(checks []limiterKey) (bool, time.Duration) {
+	now := time.Now()
+
+	buckets := make([]*tokenBucket, 0, len(checks))
+	for _, check := range checks {
+		l := check.limiter
+		if l == nil {
+			continue
+		}
+
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		b := l.bucket(check.key, now)
+		if ok, wait := b.available(l.limit, now); !ok {
+			l.limited++
+			return false, wait
+		}
+		buckets = append(buckets, b)
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// LimiterMetrics is the JSON representation of a limiter's state.
+type LimiterMetrics struct {
+	PerMinute float64 `json:"per_minute"`
+	Burst     float64 `json:"burst"`
+	// Tokens available in each bucket, for buckets that aren't full.
+	Tokens  map[string]float64 `json:"tokens"`
+	Limited uint64             `json:"limited"`
+}
+
+// Metrics returns the current state of the limiter, or nil if there is
+// no limit.
+func (l *Limiter) Metrics() *LimiterMetrics {
+	if l == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	m := &LimiterMetrics{
+		PerMinute: l.limit.PerMinute,
+		Burst:     l.limit.burst(),
+		Tokens:    make(map[string]float64, len(l.buckets)),
+		Limited:   l.limited,
+	}
+
+	for key, b := range l.buckets {
+		b.refill(l.limit, now)
+		if b.tokens < m.Burst {
+			m.Tokens[key] = b.tokens
+		}
+	}
+
+	return m
+}
+
+// clientIP returns the IP address of the request's sender.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// serverLimiters holds the server-wide rate limits, shared by all hooks.
+type serverLimiters struct {
+	all    *Limiter
+	client *Limiter
+}
+
+// checkClientRateLimits applies the server-wide and hook limits for the
+// request's client IP address. These run before the request is
+// authenticated, since they only affect the one client.
+func (hook *Hook) checkClientRateLimits(r *http.Request) (bool, time.Duration) {
+	ip := clientIP(r)
+	server := hook.serverLimiters
+	if server == nil {
+		server = &serverLimiters{}
+	}
+
+	return allowAll([]limiterKey{
+		{server.client, ip},
+		{hook.clientLimiter, ip},
+	})
+}
+
+// checkHookRateLimits applies the server-wide and hook limits shared by all
+// clients. These only run once the request is authenticated, so that
+// unauthenticated requests can't use up the tokens meant for the real
+// sender.
+func (hook *Hook) checkHookRateLimits() (bool, time.Duration) {
+	server := hook.serverLimiters
+	if server == nil {
+		server = &serverLimiters{}
+	}
+
+	return allowAll([]limiterKey{
+		{hook.limiter, ""},
+		{server.all, ""},
+	})
+}
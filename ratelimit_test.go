@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(RateLimit{PerMinute: 60, Burst: 2})
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Errorf("Request %d was limited within the burst", i)
+		}
+	}
+
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Error("Request beyond the burst was allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("Expected wait of up to one second, got %s", wait)
+	}
+
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("Request with a different key was limited")
+	}
+
+	// Pretend a second has passed.
+	l.buckets["a"].last = l.buckets["a"].last.Add(-time.Second)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("Request was limited after the bucket refilled")
+	}
+
+	m := l.Metrics()
+	if m.Limited != 1 {
+		t.Errorf("Expected 1 limited request, got %d", m.Limited)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	l := NewLimiter(RateLimit{})
+	if l != nil {
+		t.Fatal("Expected no limiter when PerMinute is 0")
+	}
+
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("Nil limiter limited a request")
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	first := NewLimiter(RateLimit{PerMinute: 1, Burst: 2})
+	second := NewLimiter(RateLimit{PerMinute: 1, Burst: 1})
+
+	checks := []limiterKey{{first, "a"}, {second, "a"}}
+	if ok, _ := allowAll(checks); !ok {
+		t.Fatal("First request was limited")
+	}
+	if ok, _ := allowAll(checks); ok {
+		t.Fatal("Request beyond the second limiter's burst was allowed")
+	}
+
+	// The rejected request shouldn't have taken a token from the first limiter.
+	if ok, _ := first.Allow("a"); !ok {
+		t.Error("Rejected request used up a token from an earlier limiter")
+	}
+	if m := second.Metrics(); m.Limited != 1 {
+		t.Errorf("Expected 1 limited request on the second limiter, got %d", m.Limited)
+	}
+	if m := first.Metrics(); m.Limited != 0 {
+		t.Errorf("Expected no limited requests on the first limiter, got %d", m.Limited)
+	}
+}
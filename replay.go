@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/dimfeld/glog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultReplayMaxEntries = 10000
+
+// How often a changed ReplayStore is written to its state file.
+const replaySaveInterval = 5 * time.Second
+
+type replayEntry struct {
+	Key  string
+	Seen time.Time
+}
+
+// ReplayStore remembers the delivery IDs seen within a time window, so that
+// captured requests can't be replayed. It holds at most maxEntries IDs,
+// forgetting the oldest ones first. If a state file is given, the store is
+// saved there every few seconds when it has changed, so that it survives
+// restarts.
+type ReplayStore struct {
+	lock       sync.Mutex
+	window     time.Duration
+	maxEntries int
+	stateFile  string
+
+	// entries is kept in the order the IDs were seen.
+	entries []replayEntry
+	seen    map[string]bool
+	dirty   bool
+
+	// saveLock keeps saves from overlapping, without holding up Check.
+	saveLock sync.Mutex
+}
+
+func NewReplayStore(window time.Duration, maxEntries int, stateFile string) *ReplayStore {
+	if maxEntries <= 0 {
+		maxEntries = defaultReplayMaxEntries
+	}
+
+	s := &ReplayStore{
+		window:     window,
+		maxEntries: maxEntries,
+		stateFile:  stateFile,
+		entries:    make([]replayEntry, 0),
+		seen:       map[string]bool{},
+	}
+
+	if stateFile != "" {
+		go s.saveLoop()
+	}
+	return s
+}
+
+// Load reads the saved state, discarding any entries that have expired.
+// A missing state file is not an error.
+func (s *ReplayStore) Load() error {
+	if s.stateFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries []replayEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, e := range entries {
+		if !s.seen[e.Key] {
+			s.entries = append(s.entries, e)
+			s.seen[e.Key] = true
+		}
+	}
+	s.expire(time.Now())
+	return nil
+}
+
+// expire removes entries that are too old, or beyond the size limit.
+// The lock must be held.
+func (s *ReplayStore) expire(now time.Time) {
+	cutoff := now.Add(-s.window)
+	remove := 0
+	for remove < len(s.entries) &&
+		(s.entries[remove].Seen.Before(cutoff) || len(s.entries)-remove > s.maxEntries) {
+		delete(s.seen, s.entries[remove].Key)
+		remove++
+	}
+
+	if remove != 0 {
+		s.entries = append(s.entries[:0:0], s.entries[remove:]...)
+	}
+}
+
+// LoadReplayStore creates the server's ReplayStore, if ReplayWindow is set,
+// and loads its saved state.
+func (c *Config) LoadReplayStore() {
+	if c.ReplayWindow <= 0 {
+		return
+	}
+
+	c.replay = NewReplayStore(time.Duration(c.ReplayWindow)*time.Second,
+		c.ReplayMaxEntries, c.ReplayStateFile)
+	err := c.replay.Load()
+	if err != nil {
+		glog.Errorf("Failed loading replay state from %s: %s\n", c.ReplayStateFile, err)
+	}
+}
+
+// checksReplays returns true if the hook rejects duplicate deliveries.
+func (hook *Hook) checksReplays() bool {
+	return hook.replay != nil && !hook.AllowDuplicates
+}
+
+func (s *ReplayStore) saveLoop() {
+	for _ = range time.Tick(replaySaveInterval) {
+		s.Flush()
+	}
+}
+
+// Flush writes the entries to the state file if they have changed since the
+// last save.
+func (s *ReplayStore) Flush() {
+	if s.stateFile == "" {
+		return
+	}
+
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+
+	s.lock.Lock()
+	if !s.dirty {
+		s.lock.Unlock()
+		return
+	}
+	data, err := json.Marshal(s.entries)
+	s.dirty = false
+	s.lock.Unlock()
+
+	if err != nil {
+		glog.Errorf("Failed encoding replay state: %s", err)
+		return
+	}
+
+	// Write to a temporary file first so that a crash can't leave a
+	// truncated state file behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.stateFile), ".replay")
+	if err != nil {
+		glog.Errorf("Failed saving replay state: %s", err)
+		return
+	}
+
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.stateFile)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		glog.Errorf("Failed saving replay state to %s: %s", s.stateFile, err)
+	}
+}
+
+// Check records the keys for a request to the hook, and returns true if
+// any of them has already been seen within the window. The keys are usually
+// the delivery ID and, for signed requests, the signature, so that changing
+// the unsigned delivery ID isn't enough to replay a request.
+func (s *ReplayStore) Check(hookUrl string, keys ...string) bool {
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expire(now)
+	for _, key := range keys {
+		if s.seen[hookUrl+" "+key] {
+			return true
+		}
+	}
+
+	for _, key := range keys {
+		key = hookUrl + " " + key
+		s.entries = append(s.entries, replayEntry{key, now})
+		s.seen[key] = true
+	}
+	s.expire(now)
+	s.dirty = true
+	return false
+}
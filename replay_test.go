@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unwebhook-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "replay.json")
+
+	s := NewReplayStore(time.Hour, 2, stateFile)
+	if s.Check("/hook", "a") {
+		t.Error("First delivery of a was marked duplicate")
+	}
+	if !s.Check("/hook", "a") {
+		t.Error("Second delivery of a was not marked duplicate")
+	}
+	if s.Check("/other", "a") {
+		t.Error("Delivery of a to another hook was marked duplicate")
+	}
+
+	// The store only holds two entries, so this should push out /hook a.
+	if s.Check("/hook", "b") {
+		t.Error("First delivery of b was marked duplicate")
+	}
+	if s.Check("/hook", "a") {
+		t.Error("Oldest entry was not evicted")
+	}
+
+	// A new store should pick up the saved state.
+	s.Flush()
+	s = NewReplayStore(time.Hour, 2, stateFile)
+	err = s.Load()
+	if err != nil {
+		t.Fatal("Failed loading state:", err)
+	}
+	if !s.Check("/hook", "a") {
+		t.Error("Saved delivery was not marked duplicate after reload")
+	}
+}
+
+func TestReplayStoreWindow(t *testing.T) {
+	s := NewReplayStore(time.Hour, 10, "")
+	s.Check("/hook", "a")
+
+	// Age the entry past the window.
+	s.entries[0].Seen = time.Now().Add(-2 * time.Hour)
+	if s.Check("/hook", "a") {
+		t.Error("Expired delivery was marked duplicate")
+	}
+}
+
+func TestReplayStoreKeys(t *testing.T) {
+	s := NewReplayStore(time.Hour, 10, "")
+	if s.Check("/hook", "a", "sha1=1234") {
+		t.Error("First delivery was marked duplicate")
+	}
+	if !s.Check("/hook", "b", "sha1=1234") {
+		t.Error("Same signature with a new ID was not marked duplicate")
+	}
+	if s.Check("/hook", "c", "sha1=5678") {
+		t.Error("New ID and signature was marked duplicate")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// runAsUser is the user and group that a hook's commands run as.
+type runAsUser struct {
+	// user is nil if only a Group was given.
+	user   *user.User
+	uid    uint32
+	gid    uint32
+	groups []uint32
+
+	// setGroups is true if the supplementary groups should be replaced with
+	// groups. This is only done for a User, since a Group alone doesn't change
+	// them, and needs root.
+	setGroups bool
+}
+
+// lookupUser finds a user by name, or by ID if the name is numeric.
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+
+	if _, numErr := strconv.ParseUint(name, 10, 32); numErr == nil {
+		if u, idErr := user.LookupId(name); idErr == nil {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("User %s does not exist", name)
+}
+
+// lookupGroup finds a group by name, or by ID if the name is numeric.
+func lookupGroup(name string) (*user.Group, error) {
+	g, err := user.LookupGroup(name)
+	if err == nil {
+		return g, nil
+	}
+
+	if _, numErr := strconv.ParseUint(name, 10, 32); numErr == nil {
+		if g, idErr := user.LookupGroupId(name); idErr == nil {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("Group %s does not exist", name)
+}
+
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Unsupported user or group ID %q", id)
+	}
+	return uint32(n), nil
+}
+
+// LookupUser resolves the hook's User and Group, so that a missing user is
+// found when the configuration is loaded rather than when the hook runs.
+func (hook *Hook) LookupUser() error {
+	hook.runAs = nil
+	if hook.User == "" && hook.Group == "" {
+		return nil
+	}
+
+	if !runAsSupported {
+		return fmt.Errorf("User and Group are not supported on this platform")
+	}
+
+	r := &runAsUser{uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+
+	if hook.User != "" {
+		u, err := lookupUser(hook.User)
+		if err != nil {
+			return err
+		}
+		r.user = u
+
+		r.uid, err = parseID(u.Uid)
+		if err != nil {
+			return err
+		}
+		r.gid, err = parseID(u.Gid)
+		if err != nil {
+			return err
+		}
+
+		groupIds, err := u.GroupIds()
+		if err != nil {
+			return fmt.Errorf("Failed looking up groups for user %s: %s", hook.User, err)
+		}
+		for _, id := range groupIds {
+			gid, err := parseID(id)
+			if err != nil {
+				return err
+			}
+			r.groups = append(r.groups, gid)
+		}
+	}
+
+	if hook.Group != "" {
+		g, err := lookupGroup(hook.Group)
+		if err != nil {
+			return err
+		}
+		r.gid, err = parseID(g.Gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	if os.Geteuid() != 0 {
+		if r.uid != uint32(os.Getuid()) || r.gid != uint32(os.Getgid()) {
+			return fmt.Errorf("Running commands as another user or group requires the server to run as root")
+		}
+	} else {
+		r.setGroups = hook.User != ""
+	}
+
+	hook.runAs = r
+	return nil
+}
+
+// runAsEnv returns the variables that describe the user that the commands
+// run as, so that they don't see the server's HOME and USER.
+func (hook *Hook) runAsEnv() []string {
+	if hook.runAs == nil || hook.runAs.user == nil {
+		return nil
+	}
+
+	u := hook.runAs.user
+	return []string{
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
+	}
+}
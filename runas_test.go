@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"testing"
+)
+
+func TestLookupUser(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip("Can't look up the current user:", err)
+	}
+
+	type userTest struct {
+		User  string
+		Group string
+		Uid   int
+		Gid   string
+		Error bool
+	}
+
+	tests := []userTest{
+		userTest{"", "", 0, "", false},
+		userTest{current.Username, "", os.Getuid(), current.Gid, false},
+		userTest{current.Uid, "", os.Getuid(), current.Gid, false},
+		userTest{"", current.Gid, os.Getuid(), current.Gid, false},
+		userTest{"unwebhook-no-such-user", "", 0, "", true},
+		userTest{"", "unwebhook-no-such-group", 0, "", true},
+	}
+
+	if os.Geteuid() != 0 {
+		// Only root can run commands as another user.
+		tests = append(tests, userTest{"root", "", 0, "", true})
+	}
+
+	for _, test := range tests {
+		hook := &Hook{Url: "/test", User: test.User, Group: test.Group}
+		err := hook.LookupUser()
+		if test.Error {
+			if err == nil {
+				t.Errorf("User %q Group %q: expected an error", test.User, test.Group)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("User %q Group %q: unexpected error %s", test.User, test.Group, err)
+			continue
+		}
+
+		if test.User == "" && test.Group == "" {
+			if hook.runAs != nil {
+				t.Error("Expected no user when none was configured")
+			}
+			continue
+		}
+
+		if hook.runAs.uid != uint32(test.Uid) {
+			t.Errorf("User %q Group %q: expected uid %d, got %d",
+				test.User, test.Group, test.Uid, hook.runAs.uid)
+		}
+		if strconv.Itoa(int(hook.runAs.gid)) != test.Gid {
+			t.Errorf("User %q Group %q: expected gid %s, got %d",
+				test.User, test.Group, test.Gid, hook.runAs.gid)
+		}
+	}
+}
+
+func TestRunAsEnv(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip("Can't look up the current user:", err)
+	}
+
+	hook := &Hook{Url: "/test", User: current.Username}
+	if err := hook.LookupUser(); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{}
+	for _, entry := range hook.buildEnv([]string{"HOME=/override"}, nil) {
+		name, value := splitEnv(entry)
+		env[name] = value
+	}
+
+	if env["USER"] != current.Username || env["LOGNAME"] != current.Username {
+		t.Errorf("Expected USER and LOGNAME %s, got %q and %q",
+			current.Username, env["USER"], env["LOGNAME"])
+	}
+	if env["HOME"] != "/override" {
+		t.Errorf("Expected Env to override HOME, got %q", env["HOME"])
+	}
+}
+
+func TestRunAsCommand(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip("Can't look up the current user:", err)
+	}
+
+	// Running as the server's own user and group works whether or not the
+	// server is root.
+	for _, hook := range []*Hook{
+		&Hook{Url: "/test", Timeout: 5, User: current.Username},
+		&Hook{Url: "/test", Timeout: 5, Group: current.Gid},
+	} {
+		if err := hook.LookupUser(); err != nil {
+			t.Fatal(err)
+		}
+
+		if hook.User == "" && hook.runAs.setGroups {
+			t.Error("Group alone should not change the supplementary groups")
+		}
+
+		err := hook.runCommand([]string{"/bin/sh", "-c", "exit 0"}, nil, "", nil)
+		if err != nil {
+			t.Errorf("User %q Group %q: failed running command: %s", hook.User, hook.Group, err)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+const runAsSupported = true
+
+// setRunAs makes the command run as the hook's User and Group, if any.
+func (hook *Hook) setRunAs(cmd *exec.Cmd) {
+	if hook.runAs == nil {
+		return
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	credential := &syscall.Credential{
+		Uid:         hook.runAs.uid,
+		Gid:         hook.runAs.gid,
+		NoSetGroups: !hook.runAs.setGroups,
+	}
+	if hook.runAs.setGroups {
+		credential.Groups = hook.runAs.groups
+	}
+	cmd.SysProcAttr.Credential = credential
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"os/exec"
+)
+
+const runAsSupported = false
+
+func (hook *Hook) setRunAs(cmd *exec.Cmd) {
+}
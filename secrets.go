@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dimfeld/glog"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const redactedText = "[REDACTED]"
+
+// secretRedactor tracks every secret value loaded by the server, so that
+// they can be scrubbed from anything written to the log.
+var secretRedactor = struct {
+	sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}{values: map[string]bool{}}
+
+// registerSecret adds a value that should never appear in the log.
+func registerSecret(value string) {
+	if value == "" {
+		return
+	}
+
+	secretRedactor.Lock()
+	defer secretRedactor.Unlock()
+
+	if secretRedactor.values[value] {
+		return
+	}
+	secretRedactor.values[value] = true
+
+	pairs := make([]string, 0, 2*len(secretRedactor.values))
+	for v := range secretRedactor.values {
+		pairs = append(pairs, v, redactedText)
+	}
+	secretRedactor.replacer = strings.NewReplacer(pairs...)
+}
+
+// secretEnvNames holds the names of the environment variables that secrets
+// and credentials are read from. These are removed from the environment
+// passed to commands.
+var secretEnvNames = struct {
+	sync.RWMutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+// registerSecretEnv records an environment variable that holds a secret.
+func registerSecretEnv(name string) {
+	secretEnvNames.Lock()
+	defer secretEnvNames.Unlock()
+	secretEnvNames.names[name] = true
+}
+
+// withoutSecretEnv returns the environment with any variables that hold
+// secrets removed.
+func withoutSecretEnv(env []string) []string {
+	secretEnvNames.RLock()
+	defer secretEnvNames.RUnlock()
+
+	result := make([]string, 0, len(env))
+	for _, entry := range env {
+		name, _ := splitEnv(entry)
+		if !secretEnvNames.names[name] {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// redact replaces any known secret values in s.
+func redact(s string) string {
+	secretRedactor.RLock()
+	defer secretRedactor.RUnlock()
+
+	if secretRedactor.replacer == nil {
+		return s
+	}
+	return secretRedactor.replacer.Replace(s)
+}
+
+// readSecretFile returns each non-blank line of the file as a secret. Putting
+// more than one secret in the file allows rotation in the same way as the
+// Secrets list.
+func readSecretFile(file string) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make([]string, 0, 1)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			secrets = append(secrets, line)
+		}
+	}
+
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("Secret file %s is empty", file)
+	}
+
+	return secrets, nil
+}
+
+// hasSecretConfig returns true if the hook configures its own secret in any
+// of the supported ways.
+func (hook *Hook) hasSecretConfig() bool {
+	return hook.Secret != "" || len(hook.Secrets) != 0 ||
+		hook.SecretFile != "" || hook.SecretEnv != ""
+}
+
+// LoadSecrets resolves the hook's secrets from the Secret, SecretFile,
+// SecretEnv, and Secrets fields. It is called again when the server
+// reloads, to pick up changed secret files.
+func (hook *Hook) LoadSecrets() error {
+	sources := 0
+	for _, s := range []string{hook.Secret, hook.SecretFile, hook.SecretEnv} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("Only one of Secret, SecretFile, and SecretEnv may be given")
+	}
+
+	secrets := make([]string, 0, len(hook.Secrets)+1)
+	if hook.Secret != "" {
+		secrets = append(secrets, hook.Secret)
+	} else if hook.SecretFile != "" {
+		fileSecrets, err := readSecretFile(hook.SecretFile)
+		if err != nil {
+			return err
+		}
+		secrets = append(secrets, fileSecrets...)
+	} else if hook.SecretEnv != "" {
+		registerSecretEnv(hook.SecretEnv)
+		value := os.Getenv(hook.SecretEnv)
+		if value == "" {
+			return fmt.Errorf("Secret environment variable %s is empty", hook.SecretEnv)
+		}
+		secrets = append(secrets, value)
+	}
+
+	for _, s := range hook.Secrets {
+		if s != "" {
+			secrets = append(secrets, s)
+		}
+	}
+
+	for _, s := range secrets {
+		registerSecret(s)
+	}
+
+	hook.secretLock.Lock()
+	hook.secrets = secrets
+	hook.secretLock.Unlock()
+	return nil
+}
+
+// ActiveSecrets returns all the secrets that the hook accepts, in the
+// order used when logging which secret matched.
+func (hook *Hook) ActiveSecrets() []string {
+	hook.secretLock.RLock()
+	defer hook.secretLock.RUnlock()
+	return hook.secrets
+}
+
+// ReloadSecrets re-reads the secrets and credentials of every hook. If a
+// hook's secrets fail to load, it keeps using its old ones.
+func (c *Config) ReloadSecrets() {
+	for _, h := range c.Hook {
+		err := h.LoadSecrets()
+		if err != nil {
+			glog.Errorf("Failed reloading secrets for %s: %s", h.Url, err)
+		}
+
+		err = h.LoadCredentials()
+		if err != nil {
+			glog.Errorf("Failed reloading credentials for %s: %s", h.Url, err)
+		}
+	}
+
+	if c.metricsHook != nil {
+		err := c.metricsHook.LoadCredentials()
+		if err != nil {
+			glog.Errorf("Failed reloading metrics credentials: %s", err)
+		}
+	}
+}
+
+func catchSIGHUP(f func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for _ = range c {
+			glog.Info("SIGHUP received, reloading secrets...")
+			f()
+		}
+	}()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadSecretsFromFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "unwebhook-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("filesecret1\n\n  filesecret2  \n")
+	f.Close()
+
+	hook := &Hook{SecretFile: f.Name(), Secrets: []string{"listsecret"}}
+	err = hook.LoadSecrets()
+	if err != nil {
+		t.Fatal("LoadSecrets failed:", err)
+	}
+
+	expected := []string{"filesecret1", "filesecret2", "listsecret"}
+	secrets := hook.ActiveSecrets()
+	if len(secrets) != len(expected) {
+		t.Fatalf("Expected secrets %v, got %v", expected, secrets)
+	}
+	for i := range expected {
+		if secrets[i] != expected[i] {
+			t.Errorf("Secret %d: expected %s, got %s", i, expected[i], secrets[i])
+		}
+	}
+
+	// Rewriting the file and reloading should replace the old secrets.
+	ioutil.WriteFile(f.Name(), []byte("filesecret3\n"), 0600)
+	err = hook.LoadSecrets()
+	if err != nil {
+		t.Fatal("Reloading secrets failed:", err)
+	}
+	if secrets = hook.ActiveSecrets(); len(secrets) != 2 || secrets[0] != "filesecret3" {
+		t.Errorf("Expected reloaded secrets, got %v", secrets)
+	}
+
+	redacted := redact("a filesecret1 and filesecret3")
+	if redacted != "a [REDACTED] and [REDACTED]" {
+		t.Errorf("Secrets were not redacted: %s", redacted)
+	}
+}
+
+func TestLoadSecretsFromEnv(t *testing.T) {
+	os.Setenv("UNWEBHOOK_TEST_SECRET", "envsecret")
+
+	hook := &Hook{SecretEnv: "UNWEBHOOK_TEST_SECRET"}
+	err := hook.LoadSecrets()
+	if err != nil {
+		t.Fatal("LoadSecrets failed:", err)
+	}
+
+	if secrets := hook.ActiveSecrets(); len(secrets) != 1 || secrets[0] != "envsecret" {
+		t.Errorf("Expected secret from environment, got %v", secrets)
+	}
+
+	hook = &Hook{Secret: "a", SecretEnv: "UNWEBHOOK_TEST_SECRET"}
+	if err = hook.LoadSecrets(); err == nil {
+		t.Error("Expected error with both Secret and SecretEnv")
+	}
+
+	hook = &Hook{SecretEnv: "UNWEBHOOK_TEST_UNSET_SECRET"}
+	if err = hook.LoadSecrets(); err == nil {
+		t.Error("Expected error with an empty environment variable")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/dimfeld/glog"
+	"net/http"
+	"sync"
+)
+
+// Reasons for rejecting a request, used in the security log and in the
+// per-hook rejection counters.
+const (
+	RejectClientCert       = "client_cert"
+	RejectBadCredentials   = "bad_credentials"
+	RejectMissingSignature = "missing_signature"
+	RejectBadSignature     = "bad_signature"
+	RejectMissingDelivery  = "missing_delivery"
+)
+
+// Reasons for rejecting a request that aren't security events. These only
+// appear in responses.
+const (
+	RejectRateLimited = "rate_limited"
+	RejectTooLarge    = "too_large"
+	RejectReadError   = "read_error"
+)
+
+// hookStats holds counters for a single hook.
+type hookStats struct {
+	sync.Mutex
+	rejections map[string]uint64
+}
+
+func (s *hookStats) addRejection(reason string) uint64 {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.rejections == nil {
+		s.rejections = map[string]uint64{}
+	}
+	s.rejections[reason]++
+
+	total := uint64(0)
+	for _, count := range s.rejections {
+		total += count
+	}
+	return total
+}
+
+// Rejections returns a copy of the hook's rejection counts, by reason.
+func (hook *Hook) Rejections() map[string]uint64 {
+	hook.stats.Lock()
+	defer hook.stats.Unlock()
+
+	result := make(map[string]uint64, len(hook.stats.rejections))
+	for reason, count := range hook.stats.rejections {
+		result[reason] = count
+	}
+	return result
+}
+
+// requestProvider guesses which service sent the request.
+func requestProvider(r *http.Request) string {
+	switch {
+	case r.Header.Get("X-GitHub-Event") != "":
+		return "github"
+	case r.Header.Get("X-Gitlab-Event") != "":
+		return "gitlab"
+	default:
+		return "unknown"
+	}
+}
+
+// deliveryID returns the unique ID that the sender assigned to this request,
+// if any.
+func deliveryID(r *http.Request) string {
+	for _, header := range []string{"X-GitHub-Delivery", "X-Gitlab-Event-UUID", "X-Request-Id"} {
+		if id := r.Header.Get(header); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// logSecurityEvent records a rejected request. The log line is in a fixed
+// key=value format so that it can be matched by log monitoring. It never
+// includes credentials or digests, since those could help an attacker.
+func logSecurityEvent(r *http.Request, hook *Hook, reason string) {
+	total := hook.stats.addRejection(reason)
+	glog.Warningf("security_event hook=%q remote=%q provider=%q delivery=%q reason=%q rejections=%d\n",
+		hook.Url, r.RemoteAddr, requestProvider(r), redact(deliveryID(r)), reason, total)
+}
@@ -4,65 +4,279 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/dimfeld/glog"
 	"github.com/dimfeld/httptreemux"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// matchSignature returns the index of the secret that produces the given
+// HMAC digest of the body, or -1 if none of them do.
+func matchSignature(secrets []string, body []byte, seen []byte) int {
+	for i, secret := range secrets {
+		hash := hmac.New(sha1.New, []byte(secret))
+		hash.Write(body)
+		if hmac.Equal(hash.Sum(nil), seen) {
+			return i
+		}
+	}
+	return -1
+}
+
+const defaultMaxBodyBytes = 25 * 1024 * 1024
+
+// maxBodyBytes returns the largest request body the hook accepts.
+func (hook *Hook) maxBodyBytes() int64 {
+	if hook.MaxBodyBytes <= 0 {
+		return defaultMaxBodyBytes
+	}
+	return hook.MaxBodyBytes
+}
+
+// unwrapFormPayload returns the JSON payload from the body. GitHub can send
+// the payload as a "payload" form field instead of as the whole body.
+func unwrapFormPayload(r *http.Request, body []byte) []byte {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return body
+	}
+
+	// Other senders may post forms without a payload field, or plain text
+	// that curl -d labels as a form but that doesn't parse as one. Those are
+	// passed through so that the raw body is still available to the hook.
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return body
+	}
+
+	payload, ok := values["payload"]
+	if !ok || len(payload) == 0 {
+		return body
+	}
+
+	return []byte(payload[0])
+}
+
+// Headers that carry credentials, which are hidden from templates.
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Hub-Signature":     true,
+	"X-Hub-Signature-256": true,
+	"X-Gitlab-Token":      true,
+}
+
+// requestInfo returns the details of the HTTP request that are exposed to
+// templates as .request. Headers with more than one value are joined with
+// commas, and only the first value of each query parameter is used.
+func requestInfo(r *http.Request) map[string]interface{} {
+	headers := make(map[string]interface{}, len(r.Header))
+	for name, values := range r.Header {
+		name = http.CanonicalHeaderKey(name)
+		if secretHeaders[name] {
+			headers[name] = redactedText
+		} else {
+			headers[name] = redact(strings.Join(values, ", "))
+		}
+	}
+
+	query := map[string]interface{}{}
+	for name, values := range r.URL.Query() {
+		if len(values) != 0 {
+			query[name] = values[0]
+		}
+	}
+
+	return map[string]interface{}{
+		"headers":     headers,
+		"query":       query,
+		"remote_addr": r.RemoteAddr,
+		"method":      r.Method,
+	}
+}
+
+// reject sends an error response with a JSON body giving the reason, so that
+// the sender's delivery log shows why the request failed.
+func reject(w http.ResponseWriter, hook *Hook, status int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(hook.filtered(reason))
+}
+
+// rateLimited rejects a request that is over a rate limit.
+func rateLimited(w http.ResponseWriter, r *http.Request, hook *Hook, wait time.Duration) {
+	glog.Warningf("Hook %s rate limited request from %s\n", r.URL.Path, r.RemoteAddr)
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	reject(w, hook, http.StatusTooManyRequests, RejectRateLimited)
+}
+
 type HookHandler func(http.ResponseWriter, *http.Request, map[string]string, *Hook)
 
 func hookHandler(w http.ResponseWriter, r *http.Request, params map[string]string, hook *Hook) {
 	githubEventType := r.Header.Get("X-GitHub-Event")
 
-	if r.ContentLength > 16384 {
-		// We should never get a request this large.
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	if ok, wait := hook.checkClientRateLimits(r); !ok {
+		rateLimited(w, r, hook, wait)
+		return
+	}
+
+	clientCert := verifiedClientCert(r)
+	if err := hook.CheckClientCert(clientCert); err != nil {
+		glog.Infof("Hook %s client certificate rejected: %s\n", r.URL.Path, err)
+		logSecurityEvent(r, hook, RejectClientCert)
+		reject(w, hook, http.StatusForbidden, RejectClientCert)
+		return
+	}
+
+	if !hook.CheckAuthorization(r) {
+		logSecurityEvent(r, hook, RejectBadCredentials)
+		w.Header().Set("WWW-Authenticate", hook.authChallenge())
+		reject(w, hook, http.StatusUnauthorized, RejectBadCredentials)
+		return
+	}
+
+	maxBody := hook.maxBodyBytes()
+	if r.ContentLength > maxBody {
+		glog.Warningf("Hook %s request from %s is too large (%d bytes)\n",
+			r.URL.Path, r.RemoteAddr, r.ContentLength)
+		reject(w, hook, http.StatusRequestEntityTooLarge, RejectTooLarge)
 		return
 	}
 
+	// ContentLength isn't set for chunked requests, so enforce the limit
+	// while reading too.
 	buffer := bytes.Buffer{}
-	buffer.ReadFrom(r.Body)
+	_, err := buffer.ReadFrom(http.MaxBytesReader(w, r.Body, maxBody))
 	r.Body.Close()
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			glog.Warningf("Hook %s request from %s is larger than %d bytes\n",
+				r.URL.Path, r.RemoteAddr, maxBody)
+			reject(w, hook, http.StatusRequestEntityTooLarge, RejectTooLarge)
+		} else {
+			glog.Errorf("Hook %s failed reading request from %s: %s\n",
+				r.URL.Path, r.RemoteAddr, err)
+			reject(w, hook, http.StatusBadRequest, RejectReadError)
+		}
+		return
+	}
 
-	if glog.V(2) {
-		niceBuffer := &bytes.Buffer{}
-		json.Indent(niceBuffer, buffer.Bytes(), "", "  ")
-		glog.Infof("Hook %s received data %s\n",
-			r.URL.Path, string(niceBuffer.Bytes()))
+	// The replay keys for the request. Signed requests are also keyed on
+	// their signature, since the delivery ID isn't covered by it.
+	var replayKeys []string
+	id := deliveryID(r)
+	if id != "" {
+		replayKeys = append(replayKeys, id)
 	}
 
-	if hook.Secret != "" {
+	if secrets := hook.ActiveSecrets(); len(secrets) != 0 {
 		secret := r.Header.Get("X-Hub-Signature")
 		if !strings.HasPrefix(secret, "sha1=") {
-			glog.Warningf("Request with no secret for hook %s from %s\n",
-				r.URL.Path, r.RemoteAddr)
-			w.WriteHeader(http.StatusForbidden)
+			logSecurityEvent(r, hook, RejectMissingSignature)
+			reject(w, hook, http.StatusForbidden, RejectMissingSignature)
 			return
 		}
 
-		hash := hmac.New(sha1.New, []byte(hook.Secret))
-		hash.Write(buffer.Bytes())
-		expected := hash.Sum(nil)
 		seen, err := hex.DecodeString(secret[5:])
-		if err != nil || !hmac.Equal(expected, seen) {
-			glog.Warningf("Request with bad secret for hook %s from %s\nExpected %s, saw %s",
-				r.URL.Path, r.RemoteAddr, hex.EncodeToString(expected), secret)
-			w.WriteHeader(http.StatusForbidden)
+		keyIndex := -1
+		if err == nil {
+			keyIndex = matchSignature(secrets, buffer.Bytes(), seen)
+		}
+
+		if keyIndex == -1 {
+			logSecurityEvent(r, hook, RejectBadSignature)
+			reject(w, hook, http.StatusForbidden, RejectBadSignature)
+			return
+		}
+
+		glog.Infof("Hook %s signature matched secret %d\n", r.URL.Path, keyIndex)
+		replayKeys = append(replayKeys, "sha1="+hex.EncodeToString(seen))
+
+		// Without an ID, a replayed request can't be told apart from a
+		// redelivery, so it isn't accepted at all.
+		if id == "" && hook.checksReplays() && githubEventType != "ping" {
+			logSecurityEvent(r, hook, RejectMissingDelivery)
+			reject(w, hook, http.StatusBadRequest, RejectMissingDelivery)
 			return
 		}
 	}
 
-	event, err := NewEvent(buffer.Bytes(), githubEventType)
-	if err != nil {
-		glog.Errorf("Error parinsg JSON for %s: %s", r.URL.Path, err)
+	if ok, wait := hook.checkHookRateLimits(); !ok {
+		rateLimited(w, r, hook, wait)
+		return
+	}
+
+	if githubEventType == "ping" {
+		glog.Infof("Hook %s received ping\n", r.URL.Path)
+		writeJSON(w, map[string]interface{}{"hook": hook.Url, "pong": true})
+		return
+	}
+
+	if hook.checksReplays() && len(replayKeys) != 0 && hook.replay.Check(hook.Url, replayKeys...) {
+		glog.Infof("Hook %s ignoring duplicate delivery %s\n", r.URL.Path, id)
+		writeJSON(w, hook.filtered("duplicate"))
 		return
 	}
+
+	// The signature covers the raw body, so this has to wait until after
+	// the signature is checked.
+	body := unwrapFormPayload(r, buffer.Bytes())
+
+	// Only dump the payload once it's known to be authentic.
+	if glog.V(2) {
+		niceBuffer := &bytes.Buffer{}
+		json.Indent(niceBuffer, body, "", "  ")
+		glog.Infof("Hook %s received data %s\n",
+			r.URL.Path, redact(string(niceBuffer.Bytes())))
+	}
+
+	var event Event
+	if len(bytes.TrimSpace(body)) == 0 {
+		event = NewRawEvent(body, githubEventType)
+	} else {
+		event, err = NewEvent(body, githubEventType)
+		if err != nil {
+			glog.Infof("Hook %s received non-JSON body: %s", r.URL.Path, err)
+			event = NewRawEvent(body, githubEventType)
+		}
+	}
 	event["urlparams"] = params
-	go hook.Execute(event)
+	event["request"] = requestInfo(r)
+
+	// Anything the sender put under .unwebhook is replaced, so that templates
+	// can trust it.
+	event["unwebhook"] = serverData{}
+	data := unwebhookData(event)
+	data["delivery"] = id
+	if clientCert != nil {
+		data["client_cert"] = clientCertInfo(clientCert)
+	}
+
+	decision := hook.Filter(event)
+	decision.body = body
+	writeJSON(w, decision)
+	if decision.Triggered {
+		go hook.Run(event, decision)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
 }
 
 func handlerWrapper(handler HookHandler, hook *Hook) httptreemux.HandlerFunc {
@@ -72,6 +286,39 @@ func handlerWrapper(handler HookHandler, hook *Hook) httptreemux.HandlerFunc {
 	}
 }
 
+// methods returns the HTTP methods that the hook accepts.
+func (hook *Hook) methods() []string {
+	if len(hook.Methods) == 0 {
+		return []string{"POST"}
+	}
+
+	methods := make([]string, len(hook.Methods))
+	for i, method := range hook.Methods {
+		methods[i] = strings.ToUpper(method)
+	}
+	return methods
+}
+
+// CheckRoutes makes sure that no two hooks, or a hook and MetricsUrl, use the
+// same URL and method. The router would panic on these when setting up.
+func (c *Config) CheckRoutes() error {
+	routes := map[string]string{}
+	for _, hook := range c.Hook {
+		if c.MetricsUrl != "" && hook.Url == c.MetricsUrl {
+			return fmt.Errorf("Hook %s uses the same URL as MetricsUrl", hook.Url)
+		}
+
+		for _, method := range hook.methods() {
+			route := method + " " + hook.Url
+			if routes[route] != "" {
+				return fmt.Errorf("More than one hook handles %s", route)
+			}
+			routes[route] = hook.Url
+		}
+	}
+	return nil
+}
+
 func SetupServer(config *Config) (net.Listener, http.Handler) {
 	var listener net.Listener = nil
 
@@ -89,10 +336,37 @@ func SetupServer(config *Config) (net.Listener, http.Handler) {
 		listener = listenFilter
 	}
 
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		tlsConfig, err := LoadTLSConfig(config.TLSCertFile, config.TLSKeyFile,
+			config.ClientCAFile)
+		if err != nil {
+			glog.Fatalf("Could not load TLS configuration: %s\n", err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	} else if config.ClientCAFile != "" {
+		glog.Fatalf("ClientCAFile requires TLSCertFile and TLSKeyFile\n")
+	}
+
+	config.limiters = &serverLimiters{
+		all:    NewLimiter(config.RateLimit),
+		client: NewLimiter(config.ClientRateLimit),
+	}
+
 	router := httptreemux.New()
 
 	for _, hook := range config.Hook {
-		router.POST(hook.Url, handlerWrapper(hookHandler, hook))
+		hook.replay = config.replay
+		hook.serverLimiters = config.limiters
+		hook.limiter = NewLimiter(hook.RateLimit)
+		hook.clientLimiter = NewLimiter(hook.ClientRateLimit)
+
+		for _, method := range hook.methods() {
+			router.Handle(method, hook.Url, handlerWrapper(hookHandler, hook))
+		}
+	}
+
+	if config.MetricsUrl != "" {
+		router.GET(config.MetricsUrl, metricsHandler(config))
 	}
 
 	return listener, router
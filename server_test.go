@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchSignature(t *testing.T) {
+	body := []byte(githubPush)
+
+	hash := hmac.New(sha1.New, []byte("newkey"))
+	hash.Write(body)
+	signature := hash.Sum(nil)
+
+	if i := matchSignature([]string{"oldkey", "newkey"}, body, signature); i != 1 {
+		t.Errorf("Expected secret 1 to match, got %d", i)
+	}
+
+	if i := matchSignature([]string{"oldkey"}, body, signature); i != -1 {
+		t.Errorf("Expected no match, got %d", i)
+	}
+
+	if i := matchSignature([]string{"newkey"}, body[1:], signature); i != -1 {
+		t.Errorf("Expected no match for altered body, got %d", i)
+	}
+}
+
+func TestHookHandlerRejections(t *testing.T) {
+	hook := &Hook{Url: "/test", Secret: "abcd"}
+	hook.LoadSecrets()
+
+	send := func(signature string) (int, map[string]interface{}) {
+		r := httptest.NewRequest("POST", "/test", strings.NewReader(githubPush))
+		r.Header.Set("X-GitHub-Event", "push")
+		if signature != "" {
+			r.Header.Set("X-Hub-Signature", signature)
+		}
+		w := httptest.NewRecorder()
+		hookHandler(w, r, map[string]string{}, hook)
+
+		result := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w.Code, result
+	}
+
+	if code, result := send(""); code != http.StatusForbidden || result["reason"] != RejectMissingSignature {
+		t.Errorf("Missing signature: expected 403 %s, got %d %v", RejectMissingSignature, code, result)
+	}
+
+	if code, result := send("sha1=0123"); code != http.StatusForbidden || result["reason"] != RejectBadSignature {
+		t.Errorf("Bad signature: expected 403 %s, got %d %v", RejectBadSignature, code, result)
+	}
+
+	rejections := hook.Rejections()
+	if rejections[RejectMissingSignature] != 1 || rejections[RejectBadSignature] != 1 {
+		t.Errorf("Unexpected rejection counts %v", rejections)
+	}
+}
+
+func TestHookHandlerBodyLimit(t *testing.T) {
+	hook := &Hook{Url: "/test", MaxBodyBytes: 100}
+
+	r := httptest.NewRequest("POST", "/test", strings.NewReader(githubPush))
+	w := httptest.NewRecorder()
+	hookHandler(w, r, map[string]string{}, hook)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("With Content-Length: expected 413, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"reason":"too_large"`) {
+		t.Errorf("With Content-Length: unexpected body %q", w.Body.String())
+	}
+
+	// Hide the length, as with a chunked request.
+	r = httptest.NewRequest("POST", "/test", strings.NewReader(githubPush))
+	r.ContentLength = -1
+	w = httptest.NewRecorder()
+	hookHandler(w, r, map[string]string{}, hook)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Without Content-Length: expected 413, got %d", w.Code)
+	}
+}
+
+func TestUnwrapFormPayload(t *testing.T) {
+	form := url.Values{"payload": []string{githubPush}}.Encode()
+
+	r := httptest.NewRequest("POST", "/test", nil)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if body := unwrapFormPayload(r, []byte(form)); string(body) != githubPush {
+		t.Error("Unwrapped payload did not match original")
+	}
+
+	for _, text := range []string{"other=abc", "deploy 100% done", "a=1;b=2"} {
+		if body := unwrapFormPayload(r, []byte(text)); string(body) != text {
+			t.Errorf("Form without a payload %q was altered: %q", text, body)
+		}
+	}
+
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if body := unwrapFormPayload(r, []byte(githubPush)); string(body) != githubPush {
+		t.Error("JSON body was altered")
+	}
+}
+
+func TestRequestInfo(t *testing.T) {
+	r := httptest.NewRequest("POST", "/test?env=staging&env=prod", nil)
+	r.Header.Set("User-Agent", "GitHub-Hookshot/abc")
+	r.Header.Set("X-Hub-Signature", "sha1=0123")
+	r.Header.Set("authorization", "Bearer abcd")
+
+	info := requestInfo(r)
+	headers := info["headers"].(map[string]interface{})
+	query := info["query"].(map[string]interface{})
+
+	if headers["User-Agent"] != "GitHub-Hookshot/abc" {
+		t.Errorf("Unexpected User-Agent %v", headers["User-Agent"])
+	}
+	if headers["X-Hub-Signature"] != redactedText {
+		t.Errorf("Signature was not redacted: %v", headers["X-Hub-Signature"])
+	}
+	if headers["Authorization"] != redactedText {
+		t.Errorf("Authorization was not redacted: %v", headers["Authorization"])
+	}
+	if query["env"] != "staging" {
+		t.Errorf("Expected first query value staging, got %v", query["env"])
+	}
+	if info["method"] != "POST" {
+		t.Errorf("Unexpected method %v", info["method"])
+	}
+}
+
+func TestHookHandlerResponse(t *testing.T) {
+	hook := &Hook{Url: "/test", AllowEvent: []string{"push"}}
+	if err := hook.CompileFilters(); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(eventType string) map[string]interface{} {
+		r := httptest.NewRequest("POST", "/test", strings.NewReader(githubPush))
+		r.Header.Set("X-GitHub-Event", eventType)
+		w := httptest.NewRecorder()
+		hookHandler(w, r, map[string]string{}, hook)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Event %s: expected 200, got %d", eventType, w.Code)
+		}
+
+		result := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Errorf("Event %s: bad JSON response %q", eventType, w.Body.String())
+		}
+		return result
+	}
+
+	if result := send("ping"); result["pong"] != true {
+		t.Errorf("Ping: unexpected response %v", result)
+	}
+
+	if result := send("push"); result["triggered"] != true {
+		t.Errorf("Push: unexpected response %v", result)
+	}
+
+	result := send("issues")
+	if result["triggered"] != false || result["reason"] == "" {
+		t.Errorf("Issues: unexpected response %v", result)
+	}
+}
+
+func TestHookHandlerReplay(t *testing.T) {
+	hook := &Hook{Url: "/test", Secret: "abcd", replay: NewReplayStore(time.Hour, 100, "")}
+	hook.LoadSecrets()
+
+	hash := hmac.New(sha1.New, []byte("abcd"))
+	hash.Write([]byte(githubPush))
+	signature := "sha1=" + hex.EncodeToString(hash.Sum(nil))
+
+	send := func(id string) (int, map[string]interface{}) {
+		r := httptest.NewRequest("POST", "/test", strings.NewReader(githubPush))
+		r.Header.Set("X-GitHub-Event", "push")
+		r.Header.Set("X-Hub-Signature", signature)
+		if id != "" {
+			r.Header.Set("X-GitHub-Delivery", id)
+		}
+		w := httptest.NewRecorder()
+		hookHandler(w, r, map[string]string{}, hook)
+
+		result := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w.Code, result
+	}
+
+	if code, result := send("a"); code != http.StatusOK || result["reason"] == "duplicate" {
+		t.Errorf("First delivery: unexpected response %d %v", code, result)
+	}
+	if _, result := send("a"); result["reason"] != "duplicate" {
+		t.Errorf("Same ID: expected duplicate, got %v", result)
+	}
+	if _, result := send("b"); result["reason"] != "duplicate" {
+		t.Errorf("Same signature with a new ID: expected duplicate, got %v", result)
+	}
+	if code, _ := send(""); code != http.StatusBadRequest {
+		t.Errorf("Missing ID: expected 400, got %d", code)
+	}
+	if hook.Rejections()[RejectMissingDelivery] != 1 {
+		t.Errorf("Unexpected rejection counts %v", hook.Rejections())
+	}
+}
+
+func TestHookHandlerRateLimitAuth(t *testing.T) {
+	hook := &Hook{Url: "/test", Secret: "abcd", limiter: NewLimiter(RateLimit{PerMinute: 1})}
+	hook.LoadSecrets()
+
+	send := func(signature string) int {
+		r := httptest.NewRequest("POST", "/test", strings.NewReader(githubPush))
+		r.Header.Set("X-GitHub-Event", "push")
+		r.Header.Set("X-Hub-Signature", signature)
+		w := httptest.NewRecorder()
+		hookHandler(w, r, map[string]string{}, hook)
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := send("sha1=0123"); code != http.StatusForbidden {
+			t.Errorf("Bad signature %d: expected 403, got %d", i, code)
+		}
+	}
+
+	hash := hmac.New(sha1.New, []byte("abcd"))
+	hash.Write([]byte(githubPush))
+	signature := "sha1=" + hex.EncodeToString(hash.Sum(nil))
+
+	if code := send(signature); code != http.StatusOK {
+		t.Errorf("Unauthenticated requests used up the hook's rate limit: got %d", code)
+	}
+	if code := send(signature); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 beyond the rate limit, got %d", code)
+	}
+}
+
+func TestHookHandlerNonObjectJSON(t *testing.T) {
+	hook := &Hook{Url: "/test"}
+
+	for _, body := range []string{"null", "[1, 2]", "42", `"deploy"`} {
+		r := httptest.NewRequest("POST", "/test", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		hookHandler(w, r, map[string]string{}, hook)
+
+		result := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		if w.Code != http.StatusOK || result["triggered"] != true {
+			t.Errorf("Body %s: unexpected response %d %v", body, w.Code, result)
+		}
+	}
+}
+
+func TestHookHandlerPlainTextForm(t *testing.T) {
+	hook := &Hook{Url: "/test"}
+
+	r := httptest.NewRequest("POST", "/test", strings.NewReader("deploy 100% done"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	hookHandler(w, r, map[string]string{}, hook)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for plain text sent as a form, got %d", w.Code)
+	}
+}
+
+func TestHookHandlerSpoofedServerData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unwebhook-spoof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hook := &Hook{
+		Url:     "/test",
+		Dir:     dir,
+		Timeout: 5,
+		Commands: [][]string{
+			[]string{"sh", "-c", "echo -n '{{ .unwebhook.client_cert.common_name }}' > cn.txt"},
+			[]string{"sh", "-c", "echo -n \"`printenv UNWEBHOOK_PAYLOAD`\" > payload.txt"},
+		},
+	}
+	if err := hook.CreateTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		`{"unwebhook": {"client_cert": {"common_name": "buildfarm-admin"}, "payload_file": "/etc/passwd"}}`,
+		`{"object_kind": "merge_request", "object_attributes": {"unwebhook": {"client_cert": {"common_name": "buildfarm-admin"}, "payload_file": "/etc/passwd"}}}`,
+	} {
+		r := httptest.NewRequest("POST", "/test", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		hookHandler(w, r, map[string]string{}, hook)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+
+		// The commands run in the background.
+		var cn, payload []byte
+		for i := 0; i < 100; i++ {
+			payload, err = ioutil.ReadFile(filepath.Join(dir, "payload.txt"))
+			if err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		cn, _ = ioutil.ReadFile(filepath.Join(dir, "cn.txt"))
+
+		if string(cn) == "buildfarm-admin" {
+			t.Errorf("Body %s: spoofed client certificate %q reached the command", body, cn)
+		}
+		if len(payload) != 0 {
+			t.Errorf("Body %s: spoofed UNWEBHOOK_PAYLOAD %q reached the command", body, payload)
+		}
+
+		os.Remove(filepath.Join(dir, "cn.txt"))
+		os.Remove(filepath.Join(dir, "payload.txt"))
+	}
+}
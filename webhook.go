@@ -9,36 +9,137 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
 	"text/template"
 )
 
+// Command is a command to run, with options. Commands given this way run
+// after any from the hook's Commands list.
+type Command struct {
+	// The executable and its arguments.
+	Args []string
+
+	// Only run this command if the condition renders "true".
+	When string
+
+	// Template for data to send to the command on stdin. "@body" sends the
+	// request body as it was received, or the payload field of a form-encoded
+	// GitHub request.
+	Stdin string
+}
+
 type Hook struct {
 	// URL at which this hook should be available.
 	Url string
+	// HTTP methods that the hook accepts. Defaults to POST.
+	Methods []string
 	// Dir is the working directory from which the command should be run.
 	// If blank, the current working directory is used.
 	Dir string
-	// Env is a list of environment variables to set. If empty, the current
-	// environment is used. Each item takes the form "key=value"
+	// Env is a list of environment variables to set. Each item takes the
+	// form "key=value". How they combine with the server's environment is
+	// controlled by EnvMode.
 	Env []string
 
+	// EnvMode is "merge", the default, to add Env to the server's environment,
+	// "replace" to use only Env and InheritEnv, or "allowlist" to use only
+	// Env and InheritEnv even if Env is empty. Overrides the server-wide
+	// EnvMode.
+	EnvMode string
+
+	// Names of variables to pass through from the server's environment in
+	// "replace" and "allowlist" modes.
+	InheritEnv []string
+
 	// If PerCommit is true, call the hook once for each commit in the message.
 	// Otherwise it is just called once per message.
 	PerCommit bool
 
-	// If empty, all events are accepted.
+	// If empty, all events are accepted. An entry may include an action,
+	// as in "pull_request.closed", to only accept that action.
 	AllowEvent []string
 
+	// If not empty, only events with one of these actions are accepted. The
+	// action comes from the "action" field for GitHub, and from
+	// object_attributes.action for GitLab.
+	AllowAction []string
+
+	// Only accept events from repositories matching these patterns, using
+	// the same syntax as AllowBranches. Repositories are named "owner/name".
+	AllowRepos []string
+
 	// Trigger the hook on changes to the following branches. If empty,
-	// the hook does not match on a particular branch.
+	// the hook does not match on a particular branch. Entries are globs, or
+	// regular expressions if they start with "re:".
 	AllowBranches []string
 
+	// Trigger the hook on pushes of the following tags, with the same
+	// matching as AllowBranches. If AllowBranches or AllowTags is given,
+	// a ref must match the list for its kind.
+	AllowTags []string
+
+	// Never trigger the hook for these branches, even if they match
+	// AllowBranches.
+	DenyBranches []string
+
+	// Control whether pushes that create, delete, or force-push a ref trigger
+	// the hook. Each may be "allow", the default, "deny", or "only".
+	OnCreated string
+	OnDeleted string
+	OnForced  string
+
+	// Only trigger the hook when the changed files include one that matches
+	// AllowPaths and doesn't match IgnorePaths. Both use the same patterns as
+	// AllowBranches. In PerCommit mode, each commit is checked separately.
+	AllowPaths  []string
+	IgnorePaths []string
+
+	// Skip commits whose messages match any of these regular expressions,
+	// or that were authored by any of the IgnoreActors. Events pushed by one
+	// of the IgnoreActors are skipped entirely.
+	SkipIfMessageMatches []string
+	IgnoreActors         []string
+
+	// Unless PerCommit is set, this chooses which commits the skip rules
+	// apply to. "head", the default, skips the event if the head commit
+	// matches. "all" skips it only if every commit matches.
+	SkipCommits string
+
+	// Only trigger the hook if this template renders "true". In PerCommit
+	// mode, it's evaluated separately for each commit.
+	When string
+
+	// Write the payload to a temporary file while the commands run. "body"
+	// writes the request body as it was received, or the payload field of a
+	// form-encoded GitHub request. "event" writes the event as JSON, including
+	// the data added by the server, and "both" writes both to separate files.
+	// The paths are in the UNWEBHOOK_BODY_FILE and UNWEBHOOK_EVENT_FILE
+	// environment variables and {{.unwebhook.body_file}} and
+	// {{.unwebhook.event_file}}. UNWEBHOOK_PAYLOAD and
+	// {{.unwebhook.payload_file}} are the body file if there is one, and the
+	// event file otherwise.
+	PayloadFile string
+
 	// Commands to run.
 	Commands [][]string
 
+	// Commands to run, with additional options. These run after Commands.
+	Command []*Command
+
 	// Override the default timeout.
 	Timeout int
 
+	// Resource limits for the commands.
+	Limits ResourceLimits
+
+	// Run the commands as this user and group, which may be names or numeric
+	// IDs. If only User is given, the user's primary group is used. Unless the
+	// server runs as root, these can only be the server's own user and group.
+	User  string
+	Group string
+
 	// Secret required in the request. Requests that don't have a matching
 	// Secret will be ignored. Note that Gitlab does not support this feature.
 	// If specified, this overrides any server-wide secret.
@@ -46,9 +147,68 @@ type Hook struct {
 	// this hook by setting the hook's secret to "none".
 	Secret string
 
-	cmdTemplate [][]*template.Template
-	envTemplate []*template.Template
-	dirTemplate *template.Template
+	// Additional secrets that are also accepted, to allow rotating the secret
+	// without dropping requests. Secret, if given, is secret 0 and these are
+	// numbered after it.
+	Secrets []string
+
+	// Read the secret from a file or environment variable instead of giving
+	// it directly. Each non-blank line of SecretFile is a separate secret.
+	// Secret files are re-read when the server receives SIGHUP.
+	SecretFile string
+	SecretEnv  string
+
+	// Bearer tokens and HTTP Basic credentials accepted by this hook. If either
+	// is given, the request's Authorization header must match one of them.
+	// A hook with credentials does not inherit the server-wide Secret.
+	AuthTokens []Credential
+	BasicAuth  []Credential
+
+	// The largest request body that this hook accepts, in bytes. Overrides the
+	// server-wide MaxBodyBytes.
+	MaxBodyBytes int64
+
+	// Limit the rate of requests to this hook, overall and from each client IP
+	// address. These apply in addition to the server-wide limits.
+	RateLimit       RateLimit
+	ClientRateLimit RateLimit
+
+	// If true, requests are processed even if their delivery ID has already
+	// been seen. See the server's ReplayWindow setting.
+	AllowDuplicates bool
+
+	// Client certificate Common Name and Subject Alternative Name patterns
+	// allowed to call this hook. If either is given, requests must present a
+	// certificate signed by the server's ClientCAFile that matches at least one
+	// of the patterns. Patterns use the same syntax as AllowBranches.
+	AllowClientCN  []string
+	AllowClientSAN []string
+
+	runAs *runAsUser
+
+	secretLock sync.RWMutex
+	secrets    []string
+
+	stats          hookStats
+	replay         *ReplayStore
+	serverLimiters *serverLimiters
+	limiter        *Limiter
+	clientLimiter  *Limiter
+
+	allowBranches  PatternList
+	allowTags      PatternList
+	denyBranches   PatternList
+	allowRepos     PatternList
+	allowPaths     PatternList
+	ignorePaths    PatternList
+	allowClientCN  PatternList
+	allowClientSAN PatternList
+	skipMessages   []*regexp.Regexp
+
+	cmdTemplate  []*commandTemplate
+	whenTemplate *template.Template
+	envTemplate  []*template.Template
+	dirTemplate  *template.Template
 }
 
 type Hooks struct {
@@ -60,20 +220,74 @@ type Config struct {
 
 	LogDir string
 
+	// Default EnvMode for hooks. See the Hook struct for more description.
+	EnvMode string
+
 	// The maximum amount of time to wait for a command to finish.
 	// Default is 5 seconds.
 	CommandTimeout int
 
+	// The largest request body accepted, in bytes. Default is 25 MiB, which is
+	// the largest payload that GitHub will send.
+	MaxBodyBytes int64
+
 	// Accept connections from only the given IP addresses.
 	AcceptIps []string
 
 	// Default secret required in requests. See the Hook struct for more description.
 	Secret string
 
+	// Additional default secrets. See the Hook struct for more description.
+	Secrets []string
+
+	// Default secret file and environment variable.
+	SecretFile string
+	SecretEnv  string
+
+	// Certificate and key for serving over TLS. If not given, the server
+	// uses plain HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// CA bundle used to verify client certificates. Setting this enables
+	// mutual TLS, and requires TLSCertFile and TLSKeyFile.
+	ClientCAFile string
+
+	// Number of seconds for which to remember delivery IDs, so that repeated
+	// deliveries can be ignored. If 0, duplicates are not detected.
+	ReplayWindow int
+
+	// The maximum number of delivery IDs to remember. Default is 10000.
+	ReplayMaxEntries int
+
+	// File in which to save the delivery IDs, so that they are remembered
+	// across restarts.
+	ReplayStateFile string
+
+	// Limit the rate of requests across all hooks, overall and from each
+	// client IP address.
+	RateLimit       RateLimit
+	ClientRateLimit RateLimit
+
+	// Path at which to serve server statistics, such as the number of
+	// rejected requests per hook, as JSON. Disabled if empty. The statistics
+	// include client IP addresses, so access to them can be restricted to
+	// MetricsAcceptIps and, if either is given, MetricsAuthTokens or
+	// MetricsBasicAuth.
+	MetricsUrl        string
+	MetricsAcceptIps  []string
+	MetricsAuthTokens []Credential
+	MetricsBasicAuth  []Credential
+
 	// Paths to search for hook files
 	HookPaths []string
 
 	Hook []*Hook
+
+	limiters    *serverLimiters
+	replay      *ReplayStore
+	metricsHook *Hook
+	metricsIps  *ListenFilter
 }
 
 func (c *Config) MergeHooks(other *Hooks) {
@@ -135,12 +349,14 @@ func (c *Config) AddHookPath(p string) {
 	}
 }
 
-func catchSIGINT(f func(), quit bool) {
+// catchShutdown calls f when the server is interrupted or asked to stop,
+// as upstart does with SIGTERM.
+func catchShutdown(f func(), quit bool) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for _ = range c {
-			glog.Info("SIGINT received...")
+		for sig := range c {
+			glog.Infof("%s received...", sig)
 			f()
 			if quit {
 				os.Exit(1)
@@ -158,11 +374,15 @@ func isDirectory(dirPath string) bool {
 }
 
 func main() {
+	runLimitsShim()
+
 	flag.Parse()
 
 	config := &Config{
-		ListenAddress:  ":80",
-		CommandTimeout: 5,
+		ListenAddress:    ":80",
+		CommandTimeout:   5,
+		MaxBodyBytes:     defaultMaxBodyBytes,
+		ReplayMaxEntries: defaultReplayMaxEntries,
 	}
 
 	mainConfigPath := os.Getenv("UNWEBHOOK_CONFFILE")
@@ -223,10 +443,16 @@ func main() {
 		}
 	}
 
+	config.LoadReplayStore()
+
 	closer := func() {
+		// Save any delivery IDs seen since the last periodic save.
+		if config.replay != nil {
+			config.replay.Flush()
+		}
 		glog.Flush()
 	}
-	catchSIGINT(closer, true)
+	catchShutdown(closer, true)
 	defer closer()
 
 	failed := false
@@ -237,22 +463,87 @@ func main() {
 			h.Timeout = config.CommandTimeout
 		}
 
+		if h.MaxBodyBytes == 0 {
+			h.MaxBodyBytes = config.MaxBodyBytes
+		}
+
+		if h.EnvMode == "" {
+			h.EnvMode = config.EnvMode
+		}
+
 		if h.Secret == "none" {
 			h.Secret = ""
-		} else if h.Secret == "" {
+			h.Secrets = nil
+			h.SecretFile = ""
+			h.SecretEnv = ""
+		} else if !h.hasSecretConfig() && !h.HasCredentials() {
 			h.Secret = config.Secret
+			h.Secrets = config.Secrets
+			h.SecretFile = config.SecretFile
+			h.SecretEnv = config.SecretEnv
 		}
 
-		err := h.CreateTemplates()
+		err := h.LoadSecrets()
+		if err != nil {
+			glog.Errorf("Failed loading secrets for %s: %s", h.Url, err)
+			failed = true
+		}
+
+		err = h.LoadCredentials()
+		if err != nil {
+			glog.Errorf("Failed loading credentials for %s: %s", h.Url, err)
+			failed = true
+		}
+
+		err = h.LookupUser()
+		if err != nil {
+			glog.Errorf("Hook %s: %s", h.Url, err)
+			failed = true
+		}
+
+		err = h.Limits.Validate()
+		if err != nil {
+			glog.Errorf("Hook %s: %s", h.Url, err)
+			failed = true
+		}
+
+		err = h.CreateTemplates()
 		if err != nil {
 			glog.Errorf("Failed parsing template %s: %s", h.Url, err)
 			failed = true
 		}
+
+		err = h.CompileFilters()
+		if err != nil {
+			glog.Errorf("Failed parsing filters for %s: %s", h.Url, err)
+			failed = true
+		}
+
+		if len(h.AllowClientCN) != 0 || len(h.AllowClientSAN) != 0 {
+			if config.ClientCAFile == "" {
+				glog.Errorf("Hook %s restricts client certificates, but no ClientCAFile is configured", h.Url)
+				failed = true
+			}
+		}
+	}
+
+	err := config.CheckRoutes()
+	if err != nil {
+		glog.Errorln(err)
+		failed = true
+	}
+
+	err = config.LoadMetricsAuth()
+	if err != nil {
+		glog.Errorf("Failed loading metrics access controls: %s", err)
+		failed = true
 	}
 
 	if failed {
 		os.Exit(1)
 	}
 
+	catchSIGHUP(config.ReloadSecrets)
+
 	RunServer(config)
 }